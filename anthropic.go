@@ -0,0 +1,278 @@
+package tokens
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"image"
+	"math"
+	"strings"
+)
+
+// AnthropicRequest is an Anthropic Messages API request. Only the fields that
+// affect the prompt are modeled.
+type AnthropicRequest struct {
+	Model      string               `json:"model"`
+	System     AnthropicContent     `json:"system,omitempty"`
+	Messages   []AnthropicMessage   `json:"messages"`
+	Tools      []AnthropicTool      `json:"tools,omitempty"`
+	ToolChoice *AnthropicToolChoice `json:"tool_choice,omitempty"`
+	MaxTokens  int                  `json:"max_tokens"`
+}
+
+// AnthropicMessage is a user or assistant message.
+type AnthropicMessage struct {
+	Role    string           `json:"role"`
+	Content AnthropicContent `json:"content"`
+}
+
+// AnthropicContent is a list of content blocks. In JSON it may also be a plain
+// string, which is a single text block.
+type AnthropicContent []AnthropicContentBlock
+
+func (c *AnthropicContent) UnmarshalJSON(b []byte) error {
+	var text string
+	if err := json.Unmarshal(b, &text); err == nil {
+		*c = AnthropicContent{{Type: "text", Text: text}}
+		return nil
+	}
+	var blocks []AnthropicContentBlock
+	if err := json.Unmarshal(b, &blocks); err != nil {
+		return err
+	}
+	*c = blocks
+	return nil
+}
+
+// AnthropicContentBlock is a text, image, tool_use or tool_result block.
+type AnthropicContentBlock struct {
+	Type string `json:"type"`
+	Text string `json:"text,omitempty"`
+
+	Source *AnthropicImageSource `json:"source,omitempty"`
+
+	// tool_use
+	ID    string          `json:"id,omitempty"`
+	Name  string          `json:"name,omitempty"`
+	Input json.RawMessage `json:"input,omitempty"`
+
+	// tool_result
+	ToolUseID string           `json:"tool_use_id,omitempty"`
+	Content   AnthropicContent `json:"content,omitempty"`
+	IsError   bool             `json:"is_error,omitempty"`
+}
+
+// AnthropicImageSource is the source of an image block.
+type AnthropicImageSource struct {
+	Type      string `json:"type"`
+	MediaType string `json:"media_type,omitempty"`
+	Data      string `json:"data,omitempty"`
+	URL       string `json:"url,omitempty"`
+}
+
+// AnthropicTool is a tool definition.
+type AnthropicTool struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	InputSchema json.RawMessage `json:"input_schema"`
+}
+
+// AnthropicToolChoice is "auto", "any", "tool" or "none".
+type AnthropicToolChoice struct {
+	Type string `json:"type"`
+	Name string `json:"name,omitempty"`
+}
+
+// AnthropicOverheads are the tokens Anthropic adds around the content of a
+// request. Anthropic doesn't publish its prompt format or tokenizer, and the
+// defaults other than the tool system prompts are unverified guesses with no
+// recorded usage behind them, so counts are estimates. Set them from your own
+// usage.input_tokens where accuracy matters.
+type AnthropicOverheads struct {
+	Request    int
+	Message    int
+	Tool       int
+	ToolUse    int
+	ToolResult int
+	// ToolSystem is the tool use system prompt added when tools are given
+	// with tool_choice "auto" or "none", and ToolSystemForced its size when
+	// tool_choice is "any" or "tool".
+	ToolSystem       int
+	ToolSystemForced int
+}
+
+// AnthropicToolSystemPrompts are the sizes of the tool use system prompt
+// Anthropic documents for each model, for auto or none and for any or tool
+// choice.
+var AnthropicToolSystemPrompts = map[string][2]int{
+	"claude-3-5-sonnet-20241022": {346, 313},
+	"claude-3-5-sonnet-20240620": {294, 261},
+	"claude-3-opus":              {530, 281},
+	"claude-3-sonnet":            {159, 235},
+	"claude-3-haiku":             {264, 340},
+}
+
+// DefaultAnthropicOverheads returns the overheads for a model.
+func DefaultAnthropicOverheads(model string) AnthropicOverheads {
+	o := AnthropicOverheads{
+		Request:          3,
+		Message:          4,
+		Tool:             3,
+		ToolUse:          8,
+		ToolResult:       6,
+		ToolSystem:       346,
+		ToolSystemForced: 313,
+	}
+	if prompts, ok := lookupModel(AnthropicToolSystemPrompts, model); ok {
+		o.ToolSystem, o.ToolSystemForced = prompts[0], prompts[1]
+	}
+	return o
+}
+
+// Anthropic images are scaled so their long edge is at most
+// anthropicMaxImageEdge and they're at most anthropicMaxImagePixels, about
+// 1600 tokens, and cost a token per anthropicPixelsPerToken.
+const (
+	anthropicMaxImageEdge       = 1568
+	anthropicMaxImagePixels     = 1600 * anthropicPixelsPerToken
+	anthropicPixelsPerToken     = 750
+	anthropicUnknownImageTokens = 1600
+)
+
+// AnthropicCounter estimates the input tokens of Anthropic Messages API
+// requests. It renders requests with the same JSON and schema formatting as
+// Counter, but with Anthropic's overheads.
+type AnthropicCounter struct {
+	Overheads AnthropicOverheads
+
+	counter *Counter
+}
+
+// NewAnthropicCounter creates a counter for an Anthropic model. Anthropic's
+// tokenizer isn't public, so unless one is given with WithTokenizer the
+// cl100k_base encoding is used as an approximation.
+func NewAnthropicCounter(model string, opts ...Option) (*AnthropicCounter, error) {
+	c := &Counter{model: model}
+	for _, opt := range opts {
+		opt(c)
+	}
+	if c.tokenizer == nil {
+		tokenizer, err := NewTiktokenTokenizer("cl100k_base")
+		if err != nil {
+			return nil, err
+		}
+		c.tokenizer = tokenizer
+	}
+
+	return &AnthropicCounter{
+		Overheads: DefaultAnthropicOverheads(model),
+		counter:   c,
+	}, nil
+}
+
+// CountRequestTokens returns the estimated input tokens of a request.
+func (a *AnthropicCounter) CountRequestTokens(req AnthropicRequest) int {
+	count := a.Overheads.Request
+
+	count += a.countContent(req.System)
+
+	// Tools are still given to the model with tool_choice "none", with the
+	// same system prompt as "auto".
+	if len(req.Tools) > 0 {
+		if req.ToolChoice != nil && (req.ToolChoice.Type == "any" || req.ToolChoice.Type == "tool") {
+			count += a.Overheads.ToolSystemForced
+		} else {
+			count += a.Overheads.ToolSystem
+		}
+		for _, tool := range req.Tools {
+			count += a.countTool(tool)
+		}
+	}
+
+	for _, message := range req.Messages {
+		count += a.Overheads.Message
+		count += a.counter.CountTokens(message.Role)
+		count += a.countContent(message.Content)
+	}
+
+	return count
+}
+
+func (a *AnthropicCounter) countTool(tool AnthropicTool) int {
+	count := a.Overheads.Tool
+	count += a.counter.CountTokens(tool.Name)
+	count += a.counter.CountTokens(tool.Description)
+
+	var schema map[string]interface{}
+	if err := json.Unmarshal(tool.InputSchema, &schema); err == nil {
+		stringified, _ := stringifyObject(schema, true)
+		count += a.counter.CountTokens(stringified)
+	} else {
+		count += a.counter.CountTokens(string(tool.InputSchema))
+	}
+
+	return count
+}
+
+func (a *AnthropicCounter) countContent(content AnthropicContent) int {
+	var count int
+	for _, block := range content {
+		switch block.Type {
+		case "text":
+			count += a.counter.CountTokens(block.Text)
+		case "image":
+			count += anthropicImageTokens(block.Source)
+		case "tool_use":
+			count += a.Overheads.ToolUse
+			count += a.counter.CountTokens(block.Name)
+			count += a.counter.CountTokens(block.ID)
+			var input map[string]interface{}
+			if err := json.Unmarshal(block.Input, &input); err == nil {
+				stringified, _ := stringifyObject(input, true)
+				count += a.counter.CountTokens(stringified)
+			} else {
+				count += a.counter.CountTokens(string(block.Input))
+			}
+		case "tool_result":
+			count += a.Overheads.ToolResult
+			count += a.counter.CountTokens(block.ToolUseID)
+			count += a.countContent(block.Content)
+		default:
+			count += a.counter.CountTokens(block.Text)
+		}
+	}
+	return count
+}
+
+// anthropicImageTokens estimates the tokens of an image from its dimensions.
+// Images given by URL, or that can't be decoded, are assumed to be the
+// largest size Anthropic doesn't scale down.
+func anthropicImageTokens(source *AnthropicImageSource) int {
+	if source == nil || source.Type != "base64" {
+		return anthropicUnknownImageTokens
+	}
+	data, err := base64.StdEncoding.DecodeString(strings.TrimSpace(source.Data))
+	if err != nil {
+		return anthropicUnknownImageTokens
+	}
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return anthropicUnknownImageTokens
+	}
+
+	w, h := float64(cfg.Width), float64(cfg.Height)
+	long := w
+	if h > long {
+		long = h
+	}
+	if long > anthropicMaxImageEdge {
+		scale := anthropicMaxImageEdge / long
+		w, h = math.Floor(w*scale), math.Floor(h*scale)
+	}
+	if w*h > anthropicMaxImagePixels {
+		scale := math.Sqrt(anthropicMaxImagePixels / (w * h))
+		w, h = math.Floor(w*scale), math.Floor(h*scale)
+	}
+
+	return int(w * h / anthropicPixelsPerToken)
+}
@@ -0,0 +1,92 @@
+package tokens
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"image"
+	"image/png"
+	"testing"
+)
+
+func TestAnthropicCountRequestTokens(t *testing.T) {
+	a, err := NewAnthropicCounter("claude-3-haiku-20240307", WithTokenizer(runeTokenizer{}))
+	if err != nil {
+		t.Fatalf("NewAnthropicCounter: %v", err)
+	}
+	o := a.Overheads
+	if o.ToolSystem != 264 || o.ToolSystemForced != 340 {
+		t.Fatalf("overheads: got %+v, want the claude-3-haiku tool system prompts", o)
+	}
+
+	tests := []struct {
+		name string
+		in   string
+		want int
+	}{{
+		name: "String content",
+		in:   `{"model":"claude-3-haiku-20240307","system":"Be brief.","messages":[{"role":"user","content":"Hi"}]}`,
+		want: o.Request + len("Be brief.") + o.Message + len("user") + len("Hi"),
+	}, {
+		name: "Content blocks",
+		in:   `{"messages":[{"role":"user","content":[{"type":"text","text":"Hi"},{"type":"text","text":"there"}]}]}`,
+		want: o.Request + o.Message + len("user") + len("Hi") + len("there"),
+	}, {
+		name: "Tool use and result",
+		in: `{"messages":[` +
+			`{"role":"assistant","content":[{"type":"tool_use","id":"t1","name":"snow","input":{"b":1,"a":"x"}}]},` +
+			`{"role":"user","content":[{"type":"tool_result","tool_use_id":"t1","content":"Deep"}]}],` +
+			`"tools":[{"name":"snow","input_schema":{"type":"object"}}],` +
+			`"tool_choice":{"type":"any"}}`,
+		want: o.Request +
+			o.ToolSystemForced + o.Tool + len("snow") + len(`{"type":"object"}`) +
+			o.Message + len("assistant") + o.ToolUse + len("snow") + len("t1") + len(`{"a":"x","b":1}`) +
+			o.Message + len("user") + o.ToolResult + len("t1") + len("Deep"),
+	}, {
+		name: "Tool choice none",
+		in:   `{"messages":[],"tools":[{"name":"snow","input_schema":{}}],"tool_choice":{"type":"none"}}`,
+		want: o.Request + o.ToolSystem + o.Tool + len("snow") + len("{}"),
+	}}
+
+	for _, tt := range tests {
+		var req AnthropicRequest
+		if err := json.Unmarshal([]byte(tt.in), &req); err != nil {
+			t.Fatalf("%s: Unmarshal: %v", tt.name, err)
+		}
+		if got := a.CountRequestTokens(req); got != tt.want {
+			t.Errorf("%s: got %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestAnthropicImageTokens(t *testing.T) {
+	encode := func(w, h int) *AnthropicImageSource {
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, image.NewGray(image.Rect(0, 0, w, h))); err != nil {
+			t.Fatal(err)
+		}
+		return &AnthropicImageSource{
+			Type:      "base64",
+			MediaType: "image/png",
+			Data:      base64.StdEncoding.EncodeToString(buf.Bytes()),
+		}
+	}
+
+	tests := []struct {
+		name   string
+		source *AnthropicImageSource
+		want   int
+	}{
+		{name: "Small", source: encode(200, 150), want: 40},
+		// 3136x1568 is scaled to 1568x784 for its long edge, then to
+		// 1549x774 to fit in 1.2 megapixels.
+		{name: "Scaled down", source: encode(3136, 1568), want: 1549 * 774 / 750},
+		{name: "Scaled down to fit pixels", source: encode(1500, 1500), want: 1095 * 1095 / 750},
+		{name: "URL", source: &AnthropicImageSource{Type: "url", URL: "https://example.com/a.png"}, want: anthropicUnknownImageTokens},
+	}
+	for _, tt := range tests {
+		if got := anthropicImageTokens(tt.source); got != tt.want {
+			t.Errorf("%s: got %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,289 @@
+package tokens
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+// ArgumentIssue is a way a tool call's arguments don't match its tool's
+// parameters schema. Call locates the tool call, such as
+// "messages[1].tool_calls[0]", and Path the value within its arguments, such
+// as "config.targets[0].port", empty for the arguments as a whole.
+type ArgumentIssue struct {
+	Call    string `json:"call,omitempty"`
+	Tool    string `json:"tool"`
+	Path    string `json:"path,omitempty"`
+	Problem string `json:"problem"`
+}
+
+// ArgumentError reports tool calls whose arguments don't match their tools.
+type ArgumentError struct {
+	Issues []ArgumentIssue
+}
+
+func (e *ArgumentError) Error() string {
+	problems := make([]string, len(e.Issues))
+	for i, issue := range e.Issues {
+		location := issue.Call
+		if issue.Path != "" {
+			location += " " + issue.Path
+		}
+		problems[i] = fmt.Sprintf("%s (%s): %s", location, issue.Tool, issue.Problem)
+	}
+	return "invalid tool call arguments: " + strings.Join(problems, "; ")
+}
+
+// ValidateArguments checks tool call arguments against a tool's parameters
+// schema: that they're a JSON object with the required properties, and that
+// every value has the type, enum value, properties and items the schema
+// gives. The returned issues have no Call.
+func ValidateArguments(tool openai.Tool, arguments string) []ArgumentIssue {
+	if tool.Function == nil {
+		return []ArgumentIssue{{Problem: "tool has no function"}}
+	}
+	def, err := toolDefFromOpenAI(*tool.Function)
+	if err != nil {
+		return []ArgumentIssue{{Tool: def.name, Problem: err.Error()}}
+	}
+	return validateArguments(def, arguments)
+}
+
+func validateArguments(def toolDef, arguments string) []ArgumentIssue {
+	var value interface{}
+	if err := json.Unmarshal([]byte(arguments), &value); err != nil {
+		return []ArgumentIssue{{Tool: def.name, Problem: fmt.Sprintf("arguments are not valid JSON: %v", err)}}
+	}
+
+	schema := def.parameters
+	if schema == nil {
+		// Functions without parameters take an empty object.
+		schema = map[string]interface{}{"type": "object"}
+	}
+
+	var issues []ArgumentIssue
+	for _, problem := range validateValue("", schema, value) {
+		issues = append(issues, ArgumentIssue{Tool: def.name, Path: problem.path, Problem: problem.problem})
+	}
+	return issues
+}
+
+// ValidateRequestToolCalls checks the tool calls of every assistant message
+// in a request against the request's tools, for example to reject few-shot
+// history with bad arguments. It returns an *ArgumentError describing any
+// issues found.
+func ValidateRequestToolCalls(req openai.ChatCompletionRequest) error {
+	tools := toolDefsByName(req.Tools)
+
+	var issues []ArgumentIssue
+	for i, m := range req.Messages {
+		for j, tc := range m.ToolCalls {
+			call := fmt.Sprintf("messages[%d].tool_calls[%d]", i, j)
+			issues = append(issues, validateToolCall(tools, call, tc)...)
+		}
+	}
+
+	return argumentError(issues)
+}
+
+// ValidateResponseToolCalls checks the tool calls of every choice in a
+// response against the tools of its request, for example to catch
+// hallucinated arguments before running tools. It returns an *ArgumentError
+// describing any issues found.
+func ValidateResponseToolCalls(
+	req openai.ChatCompletionRequest,
+	resp openai.ChatCompletionResponse,
+) error {
+	tools := toolDefsByName(req.Tools)
+
+	var issues []ArgumentIssue
+	for _, choice := range resp.Choices {
+		for j, tc := range choice.Message.ToolCalls {
+			call := fmt.Sprintf("choices[%d].message.tool_calls[%d]", choice.Index, j)
+			issues = append(issues, validateToolCall(tools, call, tc)...)
+		}
+	}
+
+	return argumentError(issues)
+}
+
+func toolDefsByName(tools []openai.Tool) map[string]toolDef {
+	defs := make(map[string]toolDef)
+	for _, def := range toolDefsFromOpenAI(tools) {
+		defs[def.name] = def
+	}
+	return defs
+}
+
+func validateToolCall(tools map[string]toolDef, call string, tc openai.ToolCall) []ArgumentIssue {
+	def, ok := tools[tc.Function.Name]
+	if !ok {
+		return []ArgumentIssue{{Call: call, Tool: tc.Function.Name, Problem: "no tool has this name"}}
+	}
+
+	issues := validateArguments(def, tc.Function.Arguments)
+	for i := range issues {
+		issues[i].Call = call
+	}
+	return issues
+}
+
+func argumentError(issues []ArgumentIssue) error {
+	if len(issues) == 0 {
+		return nil
+	}
+	return &ArgumentError{Issues: issues}
+}
+
+type schemaProblem struct {
+	path    string
+	problem string
+}
+
+// validateValue checks a value decoded from JSON against a JSON schema.
+func validateValue(path string, schema map[string]interface{}, value interface{}) []schemaProblem {
+	if anyOf, ok := schema["anyOf"].([]interface{}); ok {
+		for _, s := range anyOf {
+			if branch, ok := s.(map[string]interface{}); ok && len(validateValue(path, branch, value)) == 0 {
+				return nil
+			}
+		}
+		return []schemaProblem{{path, "doesn't match any of the allowed schemas"}}
+	}
+
+	if types := schemaTypeList(schema["type"]); len(types) > 0 {
+		var matched bool
+		for _, typ := range types {
+			if hasType(value, typ) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return []schemaProblem{{path, fmt.Sprintf("got %s, want %s", jsonType(value), strings.Join(types, " or "))}}
+		}
+	}
+
+	if enum, ok := schema["enum"].([]interface{}); ok && !inEnum(enum, value) {
+		values := make([]string, len(enum))
+		for i, v := range enum {
+			b, _ := json.Marshal(v)
+			values[i] = string(b)
+		}
+		got, _ := json.Marshal(value)
+		return []schemaProblem{{path, fmt.Sprintf("%s is not one of %s", got, strings.Join(values, ", "))}}
+	}
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		return validateObject(path, schema, v)
+	case []interface{}:
+		items, ok := schema["items"].(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		var problems []schemaProblem
+		for i, item := range v {
+			problems = append(problems, validateValue(fmt.Sprintf("%s[%d]", path, i), items, item)...)
+		}
+		return problems
+	default:
+		return nil
+	}
+}
+
+func validateObject(path string, schema map[string]interface{}, object map[string]interface{}) []schemaProblem {
+	var problems []schemaProblem
+
+	properties, _ := schema["properties"].(map[string]interface{})
+	required, _ := schema["required"].([]interface{})
+	for _, r := range required {
+		name, _ := r.(string)
+		if _, ok := object[name]; !ok {
+			problems = append(problems, schemaProblem{joinPath(path, name), "required property is missing"})
+		}
+	}
+
+	additional, _ := schema["additionalProperties"].(bool)
+	_, hasAdditional := schema["additionalProperties"]
+	for _, key := range sortedKeys(object) {
+		prop, ok := properties[key].(map[string]interface{})
+		if !ok {
+			if hasAdditional && !additional {
+				problems = append(problems, schemaProblem{joinPath(path, key), "property is not allowed"})
+			}
+			continue
+		}
+		problems = append(problems, validateValue(joinPath(path, key), prop, object[key])...)
+	}
+
+	return problems
+}
+
+func joinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+// schemaTypeList returns a schema's type, which may be a single type or a
+// list of types.
+func schemaTypeList(typ interface{}) []string {
+	switch t := typ.(type) {
+	case string:
+		return []string{t}
+	case []interface{}:
+		var types []string
+		for _, el := range t {
+			if s, ok := el.(string); ok {
+				types = append(types, s)
+			}
+		}
+		return types
+	default:
+		return nil
+	}
+}
+
+func hasType(value interface{}, typ string) bool {
+	switch typ {
+	case "integer":
+		f, ok := value.(float64)
+		return ok && f == math.Trunc(f)
+	default:
+		return jsonType(value) == typ
+	}
+}
+
+func jsonType(value interface{}) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	default:
+		return fmt.Sprintf("%T", value)
+	}
+}
+
+func inEnum(enum []interface{}, value interface{}) bool {
+	got, _ := json.Marshal(value)
+	for _, v := range enum {
+		if want, _ := json.Marshal(v); string(want) == string(got) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,120 @@
+package tokens
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+func TestValidateArguments(t *testing.T) {
+	tests := []struct {
+		name      string
+		arguments string
+		want      []string
+	}{{
+		name:      "Valid",
+		arguments: `{"config": {"region": "us-east-1", "replicas": 2, "limits": {"cpu": 0.5}}, "targets": [{"host": "a", "port": 443}]}`,
+	}, {
+		name:      "Not JSON",
+		arguments: `{"config":`,
+		want:      []string{""},
+	}, {
+		name:      "Not an object",
+		arguments: `["us-east-1"]`,
+		want:      []string{""},
+	}, {
+		name:      "Missing required",
+		arguments: `{"config": {"limits": {}}}`,
+		want:      []string{"config.region", "config.limits.cpu"},
+	}, {
+		name:      "Wrong types",
+		arguments: `{"config": {"region": 1, "replicas": 1.5}, "targets": [{"host": "a", "port": "443"}]}`,
+		want:      []string{"config.region", "config.replicas", "targets[0].port"},
+	}}
+
+	for _, tt := range tests {
+		var got []string
+		for _, issue := range ValidateArguments(deployTools[0], tt.arguments) {
+			got = append(got, issue.Path)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got issues at %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestValidateToolCalls(t *testing.T) {
+	call := func(name, arguments string) openai.ToolCall {
+		return openai.ToolCall{
+			ID:       "call_" + name,
+			Type:     openai.ToolTypeFunction,
+			Function: openai.FunctionCall{Name: name, Arguments: arguments},
+		}
+	}
+
+	req := openai.ChatCompletionRequest{
+		Messages: []openai.ChatCompletionMessage{{
+			Role:    openai.ChatMessageRoleUser,
+			Content: "Weather in Vail?",
+		}, {
+			Role: openai.ChatMessageRoleAssistant,
+			ToolCalls: []openai.ToolCall{
+				call("get_current_weather", `{"location": "Vail, CO", "unit": "kelvin"}`),
+				call("get_snow_report", `{}`),
+			},
+		}},
+		Tools: append([]openai.Tool{{
+			Type: openai.ToolTypeFunction,
+			Function: &openai.FunctionDefinition{
+				Name: "list_resorts",
+				// go-openai's jsonschema has no additionalProperties.
+				Parameters: map[string]interface{}{
+					"type":                 "object",
+					"properties":           map[string]interface{}{},
+					"additionalProperties": false,
+				},
+			},
+		}}, skiWeatherTools...),
+	}
+
+	err := ValidateRequestToolCalls(req)
+	var argErr *ArgumentError
+	if !errors.As(err, &argErr) {
+		t.Fatalf("request: got %v, want an *ArgumentError", err)
+	}
+	want := []ArgumentIssue{{
+		Call:    "messages[1].tool_calls[0]",
+		Tool:    "get_current_weather",
+		Path:    "unit",
+		Problem: `"kelvin" is not one of "celsius", "fahrenheit"`,
+	}, {
+		Call:    "messages[1].tool_calls[1]",
+		Tool:    "get_snow_report",
+		Problem: "no tool has this name",
+	}}
+	if !reflect.DeepEqual(argErr.Issues, want) {
+		t.Errorf("request: got %+v, want %+v", argErr.Issues, want)
+	}
+
+	resp := openai.ChatCompletionResponse{
+		Choices: []openai.ChatCompletionChoice{{
+			Index: 0,
+			Message: openai.ChatCompletionMessage{
+				Role:      openai.ChatMessageRoleAssistant,
+				ToolCalls: []openai.ToolCall{call("list_resorts", `{}`)},
+			},
+		}, {
+			Index: 1,
+			Message: openai.ChatCompletionMessage{
+				Role:      openai.ChatMessageRoleAssistant,
+				ToolCalls: []openai.ToolCall{call("list_resorts", `{"state": "CO"}`)},
+			},
+		}},
+	}
+	err = ValidateResponseToolCalls(req, resp)
+	if !errors.As(err, &argErr) || len(argErr.Issues) != 1 || argErr.Issues[0].Call != "choices[1].message.tool_calls[0]" {
+		t.Errorf("response: got %v, want one issue in choice 1", err)
+	}
+}
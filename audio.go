@@ -0,0 +1,299 @@
+package tokens
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+)
+
+// Audio is tokenized by duration, at different rates for input and output.
+const (
+	AudioInputTokensPerSecond  = 10
+	AudioOutputTokensPerSecond = 20
+)
+
+// tokenAudio stands in for audio tokens in a rendered request, as
+// tokenOverhead does for format overhead.
+const tokenAudio = -2
+
+func audioTokens(n int) []int {
+	tokens := make([]int, n)
+	for i := range tokens {
+		tokens[i] = tokenAudio
+	}
+	return tokens
+}
+
+// TokenBreakdown splits a count into text tokens, which include image
+// tokens and format overhead, and audio tokens, which are billed at audio
+// rates.
+type TokenBreakdown struct {
+	Text  int `json:"text"`
+	Audio int `json:"audio"`
+}
+
+// Total returns the number of text and audio tokens.
+func (b TokenBreakdown) Total() int {
+	return b.Text + b.Audio
+}
+
+func breakdown(tokens []int) TokenBreakdown {
+	var b TokenBreakdown
+	for _, t := range tokens {
+		if t == tokenAudio {
+			b.Audio++
+		} else {
+			b.Text++
+		}
+	}
+	return b
+}
+
+// CountRequestBreakdown returns the text and audio tokens of a chat
+// completion request, given in any form CountChatRequest accepts. Audio is
+// given as input_audio content parts, which go-openai doesn't model, so
+// requests with audio must be given in the wire format. Audio whose duration
+// can't be read is returned as a *CountError, along with the breakdown of
+// the rest of the request.
+func (c *Counter) CountRequestBreakdown(req any) (TokenBreakdown, error) {
+	r, err := chatRequestFrom(req)
+	if err != nil {
+		return TokenBreakdown{}, err
+	}
+	var issues []CountIssue
+	for i, m := range r.messages {
+		issues = append(issues, audioIssues(fmt.Sprintf("messages[%d].", i), m)...)
+	}
+	return breakdown(c.render(r).tokens), countError(issues)
+}
+
+// CountResponseBreakdown returns the text and audio tokens of the choices of
+// a chat completion response, given as JSON or as any value that marshals to
+// it. audioFormat is the request's audio output format; audio output is
+// counted from its duration, and its transcript as text.
+func (c *Counter) CountResponseBreakdown(resp any, audioFormat string) (TokenBreakdown, error) {
+	b, err := wireJSON(resp)
+	if err != nil {
+		return TokenBreakdown{}, err
+	}
+
+	var wire struct {
+		Choices []struct {
+			Message struct {
+				wireMessage
+				Audio *struct {
+					Data       string `json:"data"`
+					Transcript string `json:"transcript"`
+				} `json:"audio"`
+			} `json:"message"`
+		} `json:"choices"`
+	}
+	if err := json.Unmarshal(b, &wire); err != nil {
+		return TokenBreakdown{}, &RequestError{Err: err}
+	}
+
+	var count TokenBreakdown
+	for i, choice := range wire.Choices {
+		m, err := messageFromWire(choice.Message.wireMessage)
+		if err != nil {
+			return TokenBreakdown{}, &RequestError{Path: fmt.Sprintf("choices[%d].message.content", i), Err: err}
+		}
+		count.Text += len(c.encodeCompletion(m))
+
+		if audio := choice.Message.Audio; audio != nil {
+			count.Text += c.CountTokens(audio.Transcript)
+			data, err := base64.StdEncoding.DecodeString(audio.Data)
+			if err != nil {
+				return TokenBreakdown{}, &RequestError{Path: fmt.Sprintf("choices[%d].message.audio.data", i), Err: err}
+			}
+			duration, err := AudioDuration(data, audioFormat)
+			if err != nil {
+				return TokenBreakdown{}, err
+			}
+			count.Audio += audioDurationTokens(duration, AudioOutputTokensPerSecond)
+		}
+	}
+
+	return count, nil
+}
+
+func audioDurationTokens(d time.Duration, perSecond int) int {
+	return int(math.Ceil(d.Seconds() * float64(perSecond)))
+}
+
+// inputAudioTokens returns the tokens of base64 encoded input audio. Audio
+// whose duration can't be read isn't counted, and its error is reported by
+// the E variants of the Count methods.
+func inputAudioTokens(data, format string) (int, error) {
+	b, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return 0, fmt.Errorf("audio data is not base64: %w", err)
+	}
+	d, err := AudioDuration(b, format)
+	if err != nil {
+		return 0, err
+	}
+	return audioDurationTokens(d, AudioInputTokensPerSecond), nil
+}
+
+// AudioDuration returns the duration of audio in the "wav", "mp3" or "pcm16"
+// format, read from its headers without decoding it.
+func AudioDuration(data []byte, format string) (time.Duration, error) {
+	switch strings.ToLower(format) {
+	case "wav":
+		return wavDuration(data)
+	case "mp3":
+		return mp3Duration(data)
+	case "pcm16":
+		// Raw 16-bit mono samples at 24kHz.
+		return time.Duration(float64(len(data)) / (24000 * 2) * float64(time.Second)), nil
+	default:
+		return 0, fmt.Errorf("unsupported audio format %q", format)
+	}
+}
+
+// wavDuration reads the byte rate from a WAV file's fmt chunk and divides
+// the size of its data chunk by it.
+func wavDuration(data []byte) (time.Duration, error) {
+	if len(data) < 12 || string(data[0:4]) != "RIFF" || string(data[8:12]) != "WAVE" {
+		return 0, errors.New("not a WAV file")
+	}
+
+	var byteRate uint32
+	for off := 12; off+8 <= len(data); {
+		id := string(data[off : off+4])
+		size := binary.LittleEndian.Uint32(data[off+4 : off+8])
+		body := off + 8
+		switch id {
+		case "fmt ":
+			if body+12 > len(data) {
+				return 0, errors.New("truncated WAV fmt chunk")
+			}
+			byteRate = binary.LittleEndian.Uint32(data[body+8 : body+12])
+		case "data":
+			if byteRate == 0 {
+				return 0, errors.New("WAV data chunk before fmt chunk")
+			}
+			// Streamed WAVs may have a placeholder size.
+			if avail := uint32(len(data) - body); size > avail {
+				size = avail
+			}
+			return time.Duration(float64(size) / float64(byteRate) * float64(time.Second)), nil
+		}
+		// Chunks are padded to an even size.
+		off = body + int(size) + int(size%2)
+	}
+
+	return 0, errors.New("WAV file has no data chunk")
+}
+
+// MPEG audio frame header tables, indexed by version and layer.
+var (
+	mp3Bitrates = map[[2]int][16]int{
+		{1, 1}: {0, 32, 64, 96, 128, 160, 192, 224, 256, 288, 320, 352, 384, 416, 448},
+		{1, 2}: {0, 32, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 384},
+		{1, 3}: {0, 32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320},
+		{2, 1}: {0, 32, 48, 56, 64, 80, 96, 112, 128, 144, 160, 176, 192, 224, 256},
+		{2, 2}: {0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160},
+		{2, 3}: {0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160},
+	}
+	mp3SampleRates = map[int][3]int{
+		1: {44100, 48000, 32000},
+		2: {22050, 24000, 16000},
+		3: {11025, 12000, 8000}, // MPEG 2.5
+	}
+)
+
+// mp3Duration walks an MP3 file's frames, skipping any ID3v2 tag, and adds
+// up their samples, so both constant and variable bitrate files are timed
+// exactly.
+func mp3Duration(data []byte) (time.Duration, error) {
+	off := 0
+	if len(data) >= 10 && bytes.Equal(data[0:3], []byte("ID3")) {
+		// The tag size is a 28-bit syncsafe integer.
+		size := int(data[6])<<21 | int(data[7])<<14 | int(data[8])<<7 | int(data[9])
+		off = 10 + size
+	}
+
+	var (
+		seconds float64
+		frames  int
+	)
+	for off+4 <= len(data) {
+		h := binary.BigEndian.Uint32(data[off : off+4])
+		length, samples, rate, ok := mp3Frame(h)
+		if !ok {
+			if frames > 0 {
+				// Trailing tags such as ID3v1.
+				break
+			}
+			off++
+			continue
+		}
+		seconds += float64(samples) / float64(rate)
+		frames++
+		off += length
+	}
+
+	if frames == 0 {
+		return 0, errors.New("no MP3 frames found")
+	}
+	return time.Duration(seconds * float64(time.Second)), nil
+}
+
+// mp3Frame decodes an MPEG audio frame header, returning the frame's length
+// in bytes, its number of samples and its sample rate.
+func mp3Frame(h uint32) (length, samples, rate int, ok bool) {
+	if h>>21 != 0x7ff {
+		return 0, 0, 0, false
+	}
+
+	var version int
+	switch (h >> 19) & 3 {
+	case 3:
+		version = 1
+	case 2:
+		version = 2
+	case 0:
+		version = 3 // MPEG 2.5
+	default:
+		return 0, 0, 0, false
+	}
+	layer := 4 - int((h>>17)&3)
+	if layer == 4 {
+		return 0, 0, 0, false
+	}
+	bitrateIndex := int((h >> 12) & 0xf)
+	rateIndex := int((h >> 10) & 3)
+	if bitrateIndex == 0 || bitrateIndex == 15 || rateIndex == 3 {
+		return 0, 0, 0, false
+	}
+	padding := int((h >> 9) & 1)
+
+	tableVersion := version
+	if tableVersion == 3 {
+		tableVersion = 2
+	}
+	bitrate := mp3Bitrates[[2]int{tableVersion, layer}][bitrateIndex] * 1000
+	rate = mp3SampleRates[version][rateIndex]
+
+	switch {
+	case layer == 1:
+		samples = 384
+		length = (12*bitrate/rate + padding) * 4
+	case layer == 3 && version != 1:
+		samples = 576
+		length = 72*bitrate/rate + padding
+	default:
+		samples = 1152
+		length = 144*bitrate/rate + padding
+	}
+
+	return length, samples, rate, true
+}
@@ -0,0 +1,197 @@
+package tokens
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+// testWAV returns a 16-bit mono WAV file of the given duration at 16kHz.
+func testWAV(d time.Duration) []byte {
+	const byteRate = 16000 * 2
+	size := int(d.Seconds() * byteRate)
+
+	b := []byte("RIFF\x00\x00\x00\x00WAVE")
+	b = append(b, "fmt "...)
+	b = binary.LittleEndian.AppendUint32(b, 16)
+	b = binary.LittleEndian.AppendUint16(b, 1)     // PCM
+	b = binary.LittleEndian.AppendUint16(b, 1)     // mono
+	b = binary.LittleEndian.AppendUint32(b, 16000) // sample rate
+	b = binary.LittleEndian.AppendUint32(b, byteRate)
+	b = binary.LittleEndian.AppendUint16(b, 2)  // block align
+	b = binary.LittleEndian.AppendUint16(b, 16) // bits per sample
+	b = append(b, "LIST\x03\x00\x00\x00abc\x00"...)
+	b = append(b, "data"...)
+	b = binary.LittleEndian.AppendUint32(b, uint32(size))
+	b = append(b, make([]byte, size)...)
+	binary.LittleEndian.PutUint32(b[4:8], uint32(len(b)-8))
+	return b
+}
+
+// testMP3 returns an MP3 file of MPEG-1 layer III frames at 128kbps and
+// 44.1kHz, after an ID3v2 tag.
+func testMP3(frames int) []byte {
+	b := []byte("ID3\x04\x00\x00\x00\x00\x01\x00")
+	b = append(b, make([]byte, 128)...)
+	for i := 0; i < frames; i++ {
+		frame := make([]byte, 417)
+		binary.BigEndian.PutUint32(frame, 0xfffb9000)
+		b = append(b, frame...)
+	}
+	return append(b, "TAG"...)
+}
+
+func TestAudioDuration(t *testing.T) {
+	tests := []struct {
+		name   string
+		data   []byte
+		format string
+		want   time.Duration
+	}{
+		{"WAV", testWAV(1500 * time.Millisecond), "wav", 1500 * time.Millisecond},
+		{"MP3", testMP3(38), "mp3", 38 * 1152 * time.Second / 44100},
+		{"PCM", make([]byte, 24000), "pcm16", 500 * time.Millisecond},
+	}
+
+	for _, tt := range tests {
+		got, err := AudioDuration(tt.data, tt.format)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if diff := got - tt.want; diff < -time.Millisecond || diff > time.Millisecond {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	if _, err := AudioDuration(testWAV(time.Second), "flac"); err == nil {
+		t.Error("flac: got no error")
+	}
+	if _, err := AudioDuration([]byte("not audio"), "mp3"); err == nil {
+		t.Error("not audio: got no error")
+	}
+}
+
+func TestCountRequestBreakdown(t *testing.T) {
+	c := newTestCounter(t, "gpt-4o-audio-preview")
+
+	audio := base64.StdEncoding.EncodeToString(testWAV(2 * time.Second))
+	req := fmt.Sprintf(`{
+		"model": "gpt-4o-audio-preview",
+		"messages": [{
+			"role": "user",
+			"content": [
+				{"type": "text", "text": "Transcribe this."},
+				{"type": "input_audio", "input_audio": {"data": %q, "format": "wav"}}
+			]
+		}]
+	}`, audio)
+
+	got, err := c.CountRequestBreakdown([]byte(req))
+	if err != nil {
+		t.Fatal(err)
+	}
+	text := c.CountRequestTokens(openai.ChatCompletionRequest{
+		Messages: []openai.ChatCompletionMessage{{
+			Role:    openai.ChatMessageRoleUser,
+			Content: "Transcribe this.",
+		}},
+	})
+	want := TokenBreakdown{Text: text, Audio: 2 * AudioInputTokensPerSecond}
+	if got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	total, err := c.CountChatRequest([]byte(req))
+	if err != nil || total != want.Total() {
+		t.Errorf("CountChatRequest: got %d, %v, want %d", total, err, want.Total())
+	}
+}
+
+func TestAudioIssues(t *testing.T) {
+	c := newTestCounter(t, "gpt-4o-audio-preview")
+
+	req := fmt.Sprintf(`{
+		"model": "gpt-4o-audio-preview",
+		"messages": [{
+			"role": "user",
+			"content": [
+				{"type": "input_audio", "input_audio": {"data": "not base64!", "format": "wav"}},
+				{"type": "input_audio", "input_audio": {"data": %q, "format": "mp3"}},
+				{"type": "input_audio", "input_audio": {"data": %q, "format": "wav"}}
+			]
+		}]
+	}`,
+		base64.StdEncoding.EncodeToString([]byte("not an mp3")),
+		base64.StdEncoding.EncodeToString(testWAV(time.Second)),
+	)
+
+	wantPaths := []string{
+		"messages[0].content[0].input_audio",
+		"messages[0].content[1].input_audio",
+	}
+	checkIssues := func(name string, err error) {
+		t.Helper()
+		var countErr *CountError
+		if !errors.As(err, &countErr) {
+			t.Fatalf("%s: got %v, want a *CountError", name, err)
+		}
+		var paths []string
+		for _, issue := range countErr.Issues {
+			paths = append(paths, issue.Path)
+		}
+		if !reflect.DeepEqual(paths, wantPaths) {
+			t.Errorf("%s: got issues at %v, want %v", name, paths, wantPaths)
+		}
+	}
+
+	// The readable audio is still counted.
+	got, err := c.CountRequestBreakdown([]byte(req))
+	checkIssues("CountRequestBreakdown", err)
+	if got.Audio != AudioInputTokensPerSecond {
+		t.Errorf("CountRequestBreakdown: got %d audio tokens, want %d", got.Audio, AudioInputTokensPerSecond)
+	}
+
+	total, err := c.CountChatRequestE([]byte(req))
+	checkIssues("CountChatRequestE", err)
+	if total != got.Total() {
+		t.Errorf("CountChatRequestE: got %d, want %d", total, got.Total())
+	}
+}
+
+func TestCountResponseBreakdown(t *testing.T) {
+	c := newTestCounter(t, "gpt-4o-audio-preview")
+
+	audio := base64.StdEncoding.EncodeToString(testWAV(3 * time.Second))
+	resp := fmt.Sprintf(`{
+		"choices": [{
+			"index": 0,
+			"message": {
+				"role": "assistant",
+				"content": null,
+				"audio": {"id": "audio_1", "data": %q, "transcript": "Hello there."}
+			}
+		}]
+	}`, audio)
+
+	got, err := c.CountResponseBreakdown([]byte(resp), "wav")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := TokenBreakdown{Text: c.CountTokens("Hello there."), Audio: 3 * AudioOutputTokensPerSecond}
+	if got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	price, _ := DefaultPrices.Lookup("gpt-4o-audio-preview-2024-12-17")
+	cost := price.BreakdownCost(TokenBreakdown{Text: 1e6, Audio: 1e6}, TokenBreakdown{Audio: 1e6})
+	if cost != 2.50+40+80 {
+		t.Errorf("BreakdownCost: got %v", cost)
+	}
+}
@@ -0,0 +1,306 @@
+package tokens
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+const (
+	// BatchMaxRequests is the most requests a Batch API input file may hold.
+	BatchMaxRequests = 50000
+	// BatchMaxFileBytes is the largest Batch API input file OpenAI accepts.
+	BatchMaxFileBytes = 200 << 20
+	// BatchDiscount is the fraction of list price charged for batch requests.
+	BatchDiscount = 0.5
+)
+
+// BatchRequest is a single line of a Batch API input file.
+type BatchRequest struct {
+	CustomID string          `json:"custom_id"`
+	Method   string          `json:"method"`
+	URL      string          `json:"url"`
+	Body     json.RawMessage `json:"body"`
+}
+
+// BatchIssue is a problem found in a batch file. Line is 0 for problems with
+// the file as a whole.
+type BatchIssue struct {
+	Line     int    `json:"line"`
+	CustomID string `json:"custom_id,omitempty"`
+	Problem  string `json:"problem"`
+}
+
+// BatchModelTotal is the usage of every request in a batch for one model.
+type BatchModelTotal struct {
+	Requests     int `json:"requests"`
+	PromptTokens int `json:"prompt_tokens"`
+	// MaxCompletionTokens is the sum of n times max_tokens. Requests without
+	// max_tokens are counted in Unbounded instead.
+	MaxCompletionTokens int `json:"max_completion_tokens"`
+	Unbounded           int `json:"unbounded"`
+	// Cost is the batch-discounted cost of the prompt tokens plus
+	// MaxCompletionTokens, so it's an upper bound for bounded requests.
+	Cost   float64 `json:"cost"`
+	Priced bool    `json:"priced"`
+}
+
+// BatchReport summarizes a Batch API input file.
+type BatchReport struct {
+	Lines  int                         `json:"lines"`
+	Bytes  int64                       `json:"bytes"`
+	Models map[string]*BatchModelTotal `json:"models"`
+	Issues []BatchIssue                `json:"issues,omitempty"`
+	Cost   float64                     `json:"cost"`
+}
+
+// BatchOptions configures AnalyzeBatch.
+type BatchOptions struct {
+	// Prices defaults to DefaultPrices.
+	Prices PriceTable
+	// NewCounter defaults to NewCounter. Counters are created once per
+	// model.
+	NewCounter func(model string) (*Counter, error)
+}
+
+// AnalyzeBatch reads a Batch API input file line by line, counting the prompt
+// tokens of every chat completion, completion and embeddings request. Lines
+// that can't be counted, exceed the model's context window or break the file
+// limits are reported as issues rather than errors; an error is only returned
+// if r fails.
+func AnalyzeBatch(r io.Reader, opts BatchOptions) (*BatchReport, error) {
+	if opts.Prices == nil {
+		opts.Prices = DefaultPrices
+	}
+	if opts.NewCounter == nil {
+		opts.NewCounter = func(model string) (*Counter, error) {
+			return NewCounter(model)
+		}
+	}
+
+	a := batchAnalyzer{
+		opts:       opts,
+		counters:   make(map[string]*Counter),
+		counterErr: make(map[string]error),
+		seen:       make(map[string]bool),
+		report: &BatchReport{
+			Models: make(map[string]*BatchModelTotal),
+		},
+	}
+
+	br := bufio.NewReader(r)
+	for {
+		line, err := br.ReadBytes('\n')
+		if len(line) > 0 {
+			a.report.Bytes += int64(len(line))
+			if len(bytes.TrimSpace(line)) > 0 {
+				a.report.Lines++
+				a.analyzeLine(a.report.Lines, line)
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if a.report.Lines > BatchMaxRequests {
+		a.fileIssue("%d requests exceeds the limit of %d", a.report.Lines, BatchMaxRequests)
+	}
+	if a.report.Bytes > BatchMaxFileBytes {
+		a.fileIssue("%d bytes exceeds the limit of %d", a.report.Bytes, BatchMaxFileBytes)
+	}
+	for _, total := range a.report.Models {
+		a.report.Cost += total.Cost
+	}
+
+	return a.report, nil
+}
+
+type batchAnalyzer struct {
+	opts       BatchOptions
+	counters   map[string]*Counter
+	counterErr map[string]error
+	seen       map[string]bool
+	firstURL   string
+	firstModel string
+	report     *BatchReport
+}
+
+func (a *batchAnalyzer) analyzeLine(lineNo int, line []byte) {
+	var req BatchRequest
+	if err := json.Unmarshal(line, &req); err != nil {
+		a.issue(lineNo, "", "invalid JSON: %v", err)
+		return
+	}
+
+	switch {
+	case req.CustomID == "":
+		a.issue(lineNo, "", "missing custom_id")
+	case a.seen[req.CustomID]:
+		a.issue(lineNo, req.CustomID, "duplicate custom_id")
+	}
+	a.seen[req.CustomID] = true
+
+	if req.Method != http.MethodPost {
+		a.issue(lineNo, req.CustomID, "method %q is not POST", req.Method)
+	}
+	if a.firstURL == "" {
+		a.firstURL = req.URL
+	} else if req.URL != a.firstURL {
+		a.issue(lineNo, req.CustomID, "url %q differs from the file's url %q", req.URL, a.firstURL)
+	}
+
+	var (
+		model      string
+		prompt     int
+		completion int
+		err        error
+	)
+	switch req.URL {
+	case "/v1/chat/completions":
+		model, prompt, completion, err = a.countChat(req.Body)
+	case "/v1/completions":
+		model, prompt, completion, err = a.countCompletion(req.Body)
+	case "/v1/embeddings":
+		model, prompt, err = a.countEmbeddings(req.Body)
+	default:
+		err = fmt.Errorf("unsupported url %q", req.URL)
+	}
+	if err != nil {
+		a.issue(lineNo, req.CustomID, "%v", err)
+		return
+	}
+
+	if a.firstModel == "" {
+		a.firstModel = model
+	} else if model != a.firstModel {
+		a.issue(lineNo, req.CustomID, "model %q differs from the file's model %q", model, a.firstModel)
+	}
+
+	generates := req.URL != "/v1/embeddings"
+	if window, ok := ContextWindow(model); ok && generates {
+		if prompt+completion > window {
+			a.issue(
+				lineNo,
+				req.CustomID,
+				"%d prompt and %d completion tokens exceed the %d token context window of %s",
+				prompt,
+				completion,
+				window,
+				model,
+			)
+		}
+	}
+
+	total, ok := a.report.Models[model]
+	if !ok {
+		total = &BatchModelTotal{}
+		a.report.Models[model] = total
+	}
+	total.Requests++
+	total.PromptTokens += prompt
+	total.MaxCompletionTokens += completion
+	if completion == 0 && generates {
+		total.Unbounded++
+	}
+	if p, ok := a.opts.Prices.Lookup(model); ok {
+		total.Cost += p.Cost(prompt, 0, completion) * BatchDiscount
+		total.Priced = true
+	}
+}
+
+func (a *batchAnalyzer) countChat(body []byte) (string, int, int, error) {
+	var req openai.ChatCompletionRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		return "", 0, 0, fmt.Errorf("invalid chat completion body: %w", err)
+	}
+	c, err := a.counter(req.Model)
+	if err != nil {
+		return "", 0, 0, err
+	}
+	return req.Model, c.CountRequestTokens(req), MaxChatCompletionTokens(req), nil
+}
+
+func (a *batchAnalyzer) countCompletion(body []byte) (string, int, int, error) {
+	var req openai.CompletionRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		return "", 0, 0, fmt.Errorf("invalid completion body: %w", err)
+	}
+	c, err := a.counter(req.Model)
+	if err != nil {
+		return "", 0, 0, err
+	}
+	prompt, err := c.CountCompletionRequestTokens(req)
+	if err != nil {
+		return "", 0, 0, err
+	}
+	completion, err := MaxCompletionRequestTokens(req)
+	if err != nil {
+		return "", 0, 0, err
+	}
+	return req.Model, prompt, completion, nil
+}
+
+func (a *batchAnalyzer) countEmbeddings(body []byte) (string, int, error) {
+	var req openai.EmbeddingRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		return "", 0, fmt.Errorf("invalid embeddings body: %w", err)
+	}
+	model := string(req.Model)
+	c, err := a.counter(model)
+	if err != nil {
+		return "", 0, err
+	}
+
+	counts, err := c.CountEmbeddingInputs(req.Input)
+	if err != nil {
+		return "", 0, err
+	}
+	limit, hasLimit := ContextWindow(model)
+	var total int
+	for i, n := range counts {
+		if hasLimit && n > limit {
+			return "", 0, fmt.Errorf("input %d has %d tokens, more than the %d token limit of %s", i, n, limit, model)
+		}
+		total += n
+	}
+
+	return model, total, nil
+}
+
+func (a *batchAnalyzer) counter(model string) (*Counter, error) {
+	if c, ok := a.counters[model]; ok {
+		return c, nil
+	}
+	if err, ok := a.counterErr[model]; ok {
+		return nil, err
+	}
+	c, err := a.opts.NewCounter(model)
+	if err != nil {
+		a.counterErr[model] = err
+		return nil, err
+	}
+	a.counters[model] = c
+	return c, nil
+}
+
+func (a *batchAnalyzer) issue(line int, customID, format string, args ...any) {
+	a.report.Issues = append(a.report.Issues, BatchIssue{
+		Line:     line,
+		CustomID: customID,
+		Problem:  fmt.Sprintf(format, args...),
+	})
+}
+
+func (a *batchAnalyzer) fileIssue(format string, args ...any) {
+	a.issue(0, "", format, args...)
+}
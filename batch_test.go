@@ -0,0 +1,179 @@
+package tokens
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+func TestAnalyzeBatch(t *testing.T) {
+	tokenIDs := func(n int) string {
+		ids := make([]string, n)
+		for i := range ids {
+			ids[i] = "1"
+		}
+		return "[" + strings.Join(ids, ",") + "]"
+	}
+	embedding := func(id, input string) string {
+		return fmt.Sprintf(
+			`{"custom_id":%q,"method":"POST","url":"/v1/embeddings","body":{"model":"text-embedding-3-small","input":%s}}`,
+			id,
+			input,
+		)
+	}
+
+	file := strings.Join([]string{
+		embedding("a", tokenIDs(100)),
+		embedding("b", "["+tokenIDs(10)+","+tokenIDs(20)+"]"),
+		embedding("b", tokenIDs(5)),
+		embedding("c", tokenIDs(9000)),
+		`{"custom_id":"d","method":"GET","url":"/v1/embeddings","body":{"model":"text-embedding-3-small","input":[1]}}`,
+		`not json`,
+		"",
+	}, "\n")
+
+	report, err := AnalyzeBatch(strings.NewReader(file), BatchOptions{
+		// Token ID inputs don't need a tokenizer.
+		NewCounter: func(model string) (*Counter, error) {
+			return &Counter{model: model}, nil
+		},
+	})
+	if err != nil {
+		t.Fatalf("AnalyzeBatch: %v", err)
+	}
+
+	if report.Lines != 6 {
+		t.Errorf("lines: got %d, want 6", report.Lines)
+	}
+
+	total := report.Models["text-embedding-3-small"]
+	if total == nil {
+		t.Fatalf("no total for text-embedding-3-small: %+v", report.Models)
+	}
+	if total.Requests != 4 || total.PromptTokens != 136 {
+		t.Errorf("total: got %+v, want 4 requests and 136 prompt tokens", total)
+	}
+	if want := 136 * 0.02 / 1e6 * BatchDiscount; !closeTo(report.Cost, want) {
+		t.Errorf("cost: got %v, want %v", report.Cost, want)
+	}
+
+	wantIssues := map[int]string{
+		3: "duplicate custom_id",
+		4: "more than the 8191 token limit",
+		5: "is not POST",
+		6: "invalid JSON",
+	}
+	if len(report.Issues) != len(wantIssues) {
+		t.Errorf("issues: got %+v, want %d", report.Issues, len(wantIssues))
+	}
+	for _, issue := range report.Issues {
+		if want := wantIssues[issue.Line]; want == "" || !strings.Contains(issue.Problem, want) {
+			t.Errorf("line %d: got issue %q, want %q", issue.Line, issue.Problem, want)
+		}
+	}
+}
+
+func TestContextWindow(t *testing.T) {
+	tests := map[string]int{
+		"gpt-4":                  8192,
+		"gpt-4-0613":             8192,
+		"gpt-4-32k-0613":         32768,
+		"gpt-4-1106-preview":     128000,
+		"gpt-4-0125-preview":     128000,
+		"gpt-4-turbo-2024-04-09": 128000,
+		"gpt-3.5-turbo-0613":     4096,
+		"gpt-3.5-turbo-0125":     16385,
+		"gpt-4o-2024-08-06":      128000,
+	}
+	for model, want := range tests {
+		if got, ok := ContextWindow(model); !ok || got != want {
+			t.Errorf("%s: got %d, %v, want %d", model, got, ok, want)
+		}
+	}
+
+	if p, _ := DefaultPrices.Lookup("gpt-4-1106-preview"); p.Input != 10 {
+		t.Errorf("gpt-4-1106-preview: got input price %v, want gpt-4-turbo's 10", p.Input)
+	}
+}
+
+func TestAnalyzeBatchChat(t *testing.T) {
+	counters := make(map[string]*Counter)
+	newCounter := func(model string) (*Counter, error) {
+		c, err := NewCounter(model, WithTokenizer(runeTokenizer{}))
+		counters[model] = c
+		return c, err
+	}
+	chat := func(id string, req openai.ChatCompletionRequest) string {
+		body, err := json.Marshal(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fmt.Sprintf(`{"custom_id":%q,"method":"POST","url":"/v1/chat/completions","body":%s}`, id, body)
+	}
+	messages := []openai.ChatCompletionMessage{{Role: openai.ChatMessageRoleUser, Content: "Hi"}}
+	reqs := []openai.ChatCompletionRequest{
+		{Model: "gpt-4o-mini", Messages: messages, MaxTokens: 100},
+		{Model: "gpt-4o-mini", Messages: messages, MaxTokens: 50, N: 2},
+		{Model: "gpt-4o-mini", Messages: messages},
+		{Model: "gpt-4o-mini", Messages: messages, MaxTokens: 200000},
+		{Model: "gpt-3.5-turbo", Messages: messages, MaxTokens: 10},
+	}
+	lines := make([]string, len(reqs))
+	for i, req := range reqs {
+		lines[i] = chat(fmt.Sprintf("req-%d", i), req)
+	}
+
+	report, err := AnalyzeBatch(strings.NewReader(strings.Join(lines, "\n")), BatchOptions{NewCounter: newCounter})
+	if err != nil {
+		t.Fatalf("AnalyzeBatch: %v", err)
+	}
+
+	prompt := counters["gpt-4o-mini"].CountRequestTokens(reqs[0])
+	mini := report.Models["gpt-4o-mini"]
+	if mini == nil {
+		t.Fatalf("no total for gpt-4o-mini: %+v", report.Models)
+	}
+	want := BatchModelTotal{
+		Requests:            4,
+		PromptTokens:        4 * prompt,
+		MaxCompletionTokens: 100 + 2*50 + 200000,
+		Unbounded:           1,
+		Priced:              true,
+	}
+	want.Cost = DefaultPrices["gpt-4o-mini"].Cost(want.PromptTokens, 0, want.MaxCompletionTokens) * BatchDiscount
+	if !closeTo(mini.Cost, want.Cost) {
+		t.Errorf("gpt-4o-mini cost: got %v, want %v", mini.Cost, want.Cost)
+	}
+	mini.Cost = want.Cost
+	if *mini != want {
+		t.Errorf("gpt-4o-mini: got %+v, want %+v", *mini, want)
+	}
+
+	turbo := report.Models["gpt-3.5-turbo"]
+	if turbo == nil || turbo.Requests != 1 || turbo.MaxCompletionTokens != 10 {
+		t.Fatalf("gpt-3.5-turbo: got %+v, want 1 request of up to 10 completion tokens", turbo)
+	}
+	if want := want.Cost + turbo.Cost; !closeTo(report.Cost, want) {
+		t.Errorf("cost: got %v, want %v", report.Cost, want)
+	}
+	wantTurbo := DefaultPrices["gpt-3.5-turbo"].Cost(turbo.PromptTokens, 0, 10) * BatchDiscount
+	if !closeTo(turbo.Cost, wantTurbo) {
+		t.Errorf("gpt-3.5-turbo cost: got %v, want the discounted %v", turbo.Cost, wantTurbo)
+	}
+
+	wantIssues := map[int]string{
+		4: "exceed the 128000 token context window of gpt-4o-mini",
+		5: `model "gpt-3.5-turbo" differs from the file's model "gpt-4o-mini"`,
+	}
+	if len(report.Issues) != len(wantIssues) {
+		t.Errorf("issues: got %+v, want %d", report.Issues, len(wantIssues))
+	}
+	for _, issue := range report.Issues {
+		if want := wantIssues[issue.Line]; want == "" || !strings.Contains(issue.Problem, want) {
+			t.Errorf("line %d: got issue %q, want %q", issue.Line, issue.Problem, want)
+		}
+	}
+}
@@ -0,0 +1,378 @@
+package tokens
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+// BudgetPeriod is the window a budget limit applies to.
+type BudgetPeriod string
+
+const (
+	BudgetDaily   BudgetPeriod = "daily"
+	BudgetMonthly BudgetPeriod = "monthly"
+)
+
+// BudgetUnit is what a budget limit measures.
+type BudgetUnit string
+
+const (
+	BudgetTokens  BudgetUnit = "tokens"
+	BudgetDollars BudgetUnit = "dollars"
+)
+
+// BudgetLimit is a single limit on a key's usage. A zero Hard or Soft value
+// disables that limit.
+type BudgetLimit struct {
+	Period BudgetPeriod `json:"period"`
+	Unit   BudgetUnit   `json:"unit"`
+	// Hard is the amount that usage may never exceed; a reservation that
+	// would exceed it is rejected.
+	Hard float64 `json:"hard,omitempty"`
+	// Soft is the amount at which the soft limit hook fires.
+	Soft float64 `json:"soft,omitempty"`
+}
+
+// SoftLimitEvent is passed to the soft limit hook when usage crosses a soft
+// limit.
+type SoftLimitEvent struct {
+	Key   string
+	Limit BudgetLimit
+	// Used is the usage, including reservations, after the crossing.
+	Used float64
+}
+
+// BudgetExceededError is returned when a reservation would exceed a hard
+// limit.
+type BudgetExceededError struct {
+	Key       string
+	Limit     BudgetLimit
+	Used      float64
+	Requested float64
+}
+
+func (e *BudgetExceededError) Error() string {
+	return fmt.Sprintf(
+		"%s %s budget for %q exceeded: %g used, %g requested, limit %g",
+		e.Limit.Period,
+		e.Limit.Unit,
+		e.Key,
+		e.Used,
+		e.Requested,
+		e.Limit.Hard,
+	)
+}
+
+// Budget enforces per-key usage limits. Usage is reserved before a request is
+// dispatched and debited with the actual usage afterward. It's safe for
+// concurrent use.
+type Budget struct {
+	mu          sync.Mutex
+	prices      PriceTable
+	onSoftLimit func(SoftLimitEvent)
+	limits      map[string][]BudgetLimit
+	spent       map[budgetWindow]float64
+	reserved    map[budgetWindow]float64
+
+	// now is replaced in tests.
+	now func() time.Time
+}
+
+type budgetWindow struct {
+	Key    string
+	Unit   BudgetUnit
+	Period BudgetPeriod
+	Start  string
+}
+
+// NewBudget creates a budget that prices dollar limits with prices. If
+// onSoftLimit is not nil it's called, outside of any lock, whenever usage
+// crosses a soft limit.
+func NewBudget(prices PriceTable, onSoftLimit func(SoftLimitEvent)) *Budget {
+	return &Budget{
+		prices:      prices,
+		onSoftLimit: onSoftLimit,
+		limits:      make(map[string][]BudgetLimit),
+		spent:       make(map[budgetWindow]float64),
+		reserved:    make(map[budgetWindow]float64),
+		now:         time.Now,
+	}
+}
+
+// SetLimits replaces the limits for a key.
+func (b *Budget) SetLimits(key string, limits ...BudgetLimit) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.limits[key] = append([]BudgetLimit(nil), limits...)
+}
+
+// Reservation holds budget for an in-flight request until it's committed or
+// released.
+type Reservation struct {
+	budget  *Budget
+	key     string
+	model   string
+	amounts map[budgetWindow]float64
+	done    bool
+}
+
+// Reserve counts the request's prompt tokens, adds MaxTokens for each of the
+// req.N choices as reserved completion tokens and reserves the total against
+// key's limits. A request without MaxTokens reserves the model's max output
+// tokens for each choice, and is an error if those aren't known.
+func (b *Budget) Reserve(
+	key string,
+	c *Counter,
+	req openai.ChatCompletionRequest,
+) (*Reservation, error) {
+	output, err := c.maxOutputTokens(req.MaxTokens)
+	if err != nil {
+		return nil, err
+	}
+	n := req.N
+	if n < 1 {
+		n = 1
+	}
+	return b.ReserveTokens(key, c.model, c.CountRequestTokens(req), n*output)
+}
+
+// ReserveTokens reserves already counted prompt and completion tokens against
+// key's limits. If any hard limit would be exceeded nothing is reserved and a
+// *BudgetExceededError is returned. A model without a price can't be
+// reserved against dollar limits.
+func (b *Budget) ReserveTokens(
+	key, model string,
+	promptTokens, completionTokens int,
+) (*Reservation, error) {
+	r := &Reservation{
+		budget:  b,
+		key:     key,
+		model:   model,
+		amounts: make(map[budgetWindow]float64),
+	}
+
+	b.mu.Lock()
+	now := b.now()
+	var crossed []SoftLimitEvent
+	for _, limit := range b.limits[key] {
+		if limit.Unit == BudgetDollars {
+			if _, ok := b.prices.Lookup(model); !ok {
+				b.mu.Unlock()
+				return nil, fmt.Errorf("%s dollar budget for %q: no price for model %q", limit.Period, key, model)
+			}
+		}
+		w := windowFor(key, limit, now)
+		amount := b.amount(limit.Unit, model, promptTokens, 0, completionTokens)
+		used := b.spent[w] + b.reserved[w]
+
+		if limit.Hard > 0 && used+amount > limit.Hard {
+			b.mu.Unlock()
+			return nil, &BudgetExceededError{
+				Key:       key,
+				Limit:     limit,
+				Used:      used,
+				Requested: amount,
+			}
+		}
+		if limit.Soft > 0 && used < limit.Soft && used+amount >= limit.Soft {
+			crossed = append(crossed, SoftLimitEvent{
+				Key:   key,
+				Limit: limit,
+				Used:  used + amount,
+			})
+		}
+		// Limits may share a window, e.g. separate hard and soft limits.
+		r.amounts[w] = amount
+	}
+	for w, amount := range r.amounts {
+		b.reserved[w] += amount
+	}
+	b.mu.Unlock()
+
+	b.notify(crossed)
+
+	return r, nil
+}
+
+// Commit releases the reservation and debits the actual usage. Actual usage
+// is always debited, even if it exceeds a hard limit.
+func (r *Reservation) Commit(usage openai.Usage) {
+	r.CommitTokens(usage.PromptTokens, 0, usage.CompletionTokens)
+}
+
+// CommitTokens is like Commit for usage broken down by hand, with cached
+// tokens being a subset of prompt tokens.
+func (r *Reservation) CommitTokens(promptTokens, cachedTokens, completionTokens int) {
+	b := r.budget
+
+	b.mu.Lock()
+	if r.done {
+		b.mu.Unlock()
+		return
+	}
+	r.release()
+
+	var (
+		now     = b.now()
+		debited = make(map[budgetWindow]float64)
+		crossed []SoftLimitEvent
+	)
+	for _, limit := range b.limits[r.key] {
+		w := windowFor(r.key, limit, now)
+		amount := b.amount(limit.Unit, r.model, promptTokens, cachedTokens, completionTokens)
+		used := b.spent[w] - debited[w] + b.reserved[w]
+		// The reservation was counted as used when it was made, so the hook
+		// has already fired if it crossed the soft limit.
+		if limit.Soft > 0 && used+r.amounts[w] < limit.Soft && used+amount >= limit.Soft {
+			crossed = append(crossed, SoftLimitEvent{
+				Key:   r.key,
+				Limit: limit,
+				Used:  used + amount,
+			})
+		}
+		if _, ok := debited[w]; !ok {
+			b.spent[w] += amount
+			debited[w] = amount
+		}
+	}
+	b.mu.Unlock()
+
+	b.notify(crossed)
+}
+
+// CommitPrediction is like CommitTokens for a request with a predicted
+// output, debiting the rejected prediction tokens along with the output the
+// model generated. Reserve such requests with ReserveTokens and
+// Counter.MaxPredictedCompletionTokens, since Reserve can't see the
+// prediction.
+func (r *Reservation) CommitPrediction(promptTokens, cachedTokens int, u PredictionUsage) {
+	r.CommitTokens(promptTokens, cachedTokens, u.Generated()+u.Rejected)
+}
+
+// Release returns the reserved budget without debiting anything, e.g. when
+// the request failed before reaching the model.
+func (r *Reservation) Release() {
+	r.budget.mu.Lock()
+	defer r.budget.mu.Unlock()
+	if !r.done {
+		r.release()
+	}
+}
+
+// release must be called with the budget lock held.
+func (r *Reservation) release() {
+	b := r.budget
+	for w, amount := range r.amounts {
+		b.reserved[w] -= amount
+		if b.reserved[w] <= 0 {
+			delete(b.reserved, w)
+		}
+	}
+	r.done = true
+}
+
+// Used returns the committed and reserved usage for a key in the current
+// window of limit.
+func (b *Budget) Used(key string, limit BudgetLimit) (spent, reserved float64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	w := windowFor(key, limit, b.now())
+	return b.spent[w], b.reserved[w]
+}
+
+func (b *Budget) amount(unit BudgetUnit, model string, prompt, cached, completion int) float64 {
+	switch unit {
+	case BudgetDollars:
+		p, _ := b.prices.Lookup(model)
+		return p.Cost(prompt, cached, completion)
+	default:
+		return float64(prompt + completion)
+	}
+}
+
+func (b *Budget) notify(crossed []SoftLimitEvent) {
+	if b.onSoftLimit == nil {
+		return
+	}
+	for _, e := range crossed {
+		b.onSoftLimit(e)
+	}
+}
+
+func windowFor(key string, limit BudgetLimit, now time.Time) budgetWindow {
+	now = now.UTC()
+	start := now.Format("2006-01-02")
+	if limit.Period == BudgetMonthly {
+		start = now.Format("2006-01")
+	}
+	return budgetWindow{
+		Key:    key,
+		Unit:   limit.Unit,
+		Period: limit.Period,
+		Start:  start,
+	}
+}
+
+// BudgetSnapshot is the committed usage of a Budget. In-flight reservations
+// are not included.
+type BudgetSnapshot struct {
+	Limits map[string][]BudgetLimit `json:"limits"`
+	Spent  []BudgetSpend            `json:"spent"`
+}
+
+// BudgetSpend is the committed usage for one key in one window.
+type BudgetSpend struct {
+	Key    string       `json:"key"`
+	Unit   BudgetUnit   `json:"unit"`
+	Period BudgetPeriod `json:"period"`
+	Start  string       `json:"start"`
+	Amount float64      `json:"amount"`
+}
+
+// Snapshot returns the limits and committed usage, suitable for encoding as
+// JSON and passing to Restore.
+func (b *Budget) Snapshot() BudgetSnapshot {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	s := BudgetSnapshot{Limits: make(map[string][]BudgetLimit)}
+	for key, limits := range b.limits {
+		s.Limits[key] = append([]BudgetLimit(nil), limits...)
+	}
+	for w, amount := range b.spent {
+		s.Spent = append(s.Spent, BudgetSpend{
+			Key:    w.Key,
+			Unit:   w.Unit,
+			Period: w.Period,
+			Start:  w.Start,
+			Amount: amount,
+		})
+	}
+
+	return s
+}
+
+// Restore replaces the limits and committed usage with a snapshot. Existing
+// reservations are kept.
+func (b *Budget) Restore(s BudgetSnapshot) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.limits = make(map[string][]BudgetLimit)
+	for key, limits := range s.Limits {
+		b.limits[key] = append([]BudgetLimit(nil), limits...)
+	}
+	b.spent = make(map[budgetWindow]float64)
+	for _, spend := range s.Spent {
+		w := budgetWindow{
+			Key:    spend.Key,
+			Unit:   spend.Unit,
+			Period: spend.Period,
+			Start:  spend.Start,
+		}
+		b.spent[w] += spend.Amount
+	}
+}
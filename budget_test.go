@@ -0,0 +1,204 @@
+package tokens
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+func TestBudgetLimits(t *testing.T) {
+	var soft []SoftLimitEvent
+	budget := NewBudget(DefaultPrices, func(e SoftLimitEvent) {
+		soft = append(soft, e)
+	})
+	budget.now = func() time.Time {
+		return time.Date(2024, 6, 22, 10, 0, 0, 0, time.UTC)
+	}
+	daily := BudgetLimit{Period: BudgetDaily, Unit: BudgetTokens, Hard: 1000, Soft: 800}
+	budget.SetLimits("acme", daily)
+
+	r, err := budget.ReserveTokens("acme", "gpt-4o", 500, 200)
+	if err != nil {
+		t.Fatalf("ReserveTokens: %v", err)
+	}
+
+	// The first reservation is still in flight, so this would exceed the hard
+	// limit.
+	_, err = budget.ReserveTokens("acme", "gpt-4o", 200, 200)
+	var exceeded *BudgetExceededError
+	if !errors.As(err, &exceeded) {
+		t.Fatalf("ReserveTokens: got %v, want *BudgetExceededError", err)
+	}
+	if exceeded.Used != 700 || exceeded.Requested != 400 {
+		t.Errorf("exceeded: got used %v requested %v, want 700 and 400", exceeded.Used, exceeded.Requested)
+	}
+
+	r.Commit(openai.Usage{PromptTokens: 500, CompletionTokens: 50})
+	if spent, reserved := budget.Used("acme", daily); spent != 550 || reserved != 0 {
+		t.Errorf("after commit: got spent %v reserved %v, want 550 and 0", spent, reserved)
+	}
+
+	r, err = budget.ReserveTokens("acme", "gpt-4o", 200, 200)
+	if err != nil {
+		t.Fatalf("ReserveTokens after commit: %v", err)
+	}
+	if len(soft) != 1 || soft[0].Used != 950 {
+		t.Errorf("soft limit events: got %+v, want one at 950", soft)
+	}
+	r.Release()
+	if _, reserved := budget.Used("acme", daily); reserved != 0 {
+		t.Errorf("after release: got reserved %v, want 0", reserved)
+	}
+
+	// Other keys and the next day are unaffected.
+	if _, err := budget.ReserveTokens("globex", "gpt-4o", 5000, 0); err != nil {
+		t.Errorf("ReserveTokens without limits: %v", err)
+	}
+	budget.now = func() time.Time {
+		return time.Date(2024, 6, 23, 10, 0, 0, 0, time.UTC)
+	}
+	if _, err := budget.ReserveTokens("acme", "gpt-4o", 900, 0); err != nil {
+		t.Errorf("ReserveTokens next day: %v", err)
+	}
+}
+
+func TestBudgetSnapshot(t *testing.T) {
+	budget := NewBudget(DefaultPrices, nil)
+	monthly := BudgetLimit{Period: BudgetMonthly, Unit: BudgetDollars, Hard: 1}
+	budget.SetLimits("acme", monthly)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r, err := budget.ReserveTokens("acme", "gpt-4o-mini", 10000, 1000)
+			if err != nil {
+				t.Errorf("ReserveTokens: %v", err)
+				return
+			}
+			r.CommitTokens(10000, 0, 1000)
+		}()
+	}
+	wg.Wait()
+
+	b, err := json.Marshal(budget.Snapshot())
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	var snapshot BudgetSnapshot
+	if err := json.Unmarshal(b, &snapshot); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+
+	restored := NewBudget(DefaultPrices, nil)
+	restored.Restore(snapshot)
+
+	want := 10 * (10000*0.15 + 1000*0.60) / 1e6
+	if spent, _ := restored.Used("acme", monthly); !closeTo(spent, want) {
+		t.Errorf("restored spend: got %v, want %v", spent, want)
+	}
+}
+
+func TestBudgetSoftLimitFiresOnce(t *testing.T) {
+	var soft []SoftLimitEvent
+	budget := NewBudget(DefaultPrices, func(e SoftLimitEvent) {
+		soft = append(soft, e)
+	})
+	daily := BudgetLimit{Period: BudgetDaily, Unit: BudgetTokens, Soft: 100}
+	budget.SetLimits("acme", daily)
+
+	// The reservation crosses the soft limit, and so does the commit.
+	r, err := budget.ReserveTokens("acme", "gpt-4o", 50, 100)
+	if err != nil {
+		t.Fatalf("ReserveTokens: %v", err)
+	}
+	r.CommitTokens(50, 0, 80)
+	if len(soft) != 1 || soft[0].Used != 150 {
+		t.Errorf("soft limit events: got %+v, want one at 150", soft)
+	}
+
+	// A reservation under the soft limit whose usage crosses it fires at
+	// commit.
+	soft = nil
+	budget.SetLimits("globex", daily)
+	r, err = budget.ReserveTokens("globex", "gpt-4o", 50, 10)
+	if err != nil {
+		t.Fatalf("ReserveTokens: %v", err)
+	}
+	r.CommitTokens(50, 0, 60)
+	if len(soft) != 1 || soft[0].Used != 110 {
+		t.Errorf("soft limit events: got %+v, want one at 110", soft)
+	}
+}
+
+func TestBudgetUnpricedModel(t *testing.T) {
+	budget := NewBudget(DefaultPrices, nil)
+	budget.SetLimits("acme", BudgetLimit{Period: BudgetMonthly, Unit: BudgetDollars, Hard: 1})
+	if _, err := budget.ReserveTokens("acme", "my-fine-tune", 1000, 0); err == nil {
+		t.Error("ReserveTokens: got nil error for a model without a price")
+	}
+	if _, reserved := budget.Used("acme", BudgetLimit{Period: BudgetMonthly, Unit: BudgetDollars}); reserved != 0 {
+		t.Errorf("reserved: got %v, want 0", reserved)
+	}
+
+	// Token limits don't need a price.
+	budget.SetLimits("acme", BudgetLimit{Period: BudgetMonthly, Unit: BudgetTokens, Hard: 10000})
+	if _, err := budget.ReserveTokens("acme", "my-fine-tune", 1000, 0); err != nil {
+		t.Errorf("ReserveTokens with a token limit: %v", err)
+	}
+}
+
+func TestBudgetCommitPrediction(t *testing.T) {
+	budget := NewBudget(DefaultPrices, nil)
+	daily := BudgetLimit{Period: BudgetDaily, Unit: BudgetTokens, Hard: 1000}
+	budget.SetLimits("acme", daily)
+
+	r, err := budget.ReserveTokens("acme", "gpt-4o", 100, 500)
+	if err != nil {
+		t.Fatalf("ReserveTokens: %v", err)
+	}
+	// 50 tokens of output, 30 of them accepted from the prediction, and 12
+	// rejected prediction tokens.
+	r.CommitPrediction(100, 0, PredictionUsage{Predicted: 60, Accepted: 30, Rejected: 12, Completion: 62})
+	if spent, reserved := budget.Used("acme", daily); spent != 162 || reserved != 0 {
+		t.Errorf("got spent %v reserved %v, want 162 and 0", spent, reserved)
+	}
+}
+
+func TestBudgetReserveWithoutMaxTokens(t *testing.T) {
+	budget := NewBudget(DefaultPrices, nil)
+	daily := BudgetLimit{Period: BudgetDaily, Unit: BudgetTokens, Hard: 100000}
+	budget.SetLimits("acme", daily)
+
+	c := newTestCounter(t, "gpt-4o-mini")
+	req := openai.ChatCompletionRequest{
+		Model:    "gpt-4o-mini",
+		Messages: []openai.ChatCompletionMessage{{Role: openai.ChatMessageRoleUser, Content: "hi"}},
+		N:        2,
+	}
+	r, err := budget.Reserve("acme", c, req)
+	if err != nil {
+		t.Fatalf("Reserve: %v", err)
+	}
+	want := float64(c.CountRequestTokens(req) + 2*16384)
+	if _, reserved := budget.Used("acme", daily); reserved != want {
+		t.Errorf("reserved: got %v, want %v", reserved, want)
+	}
+	r.Release()
+
+	// Without max_tokens, a model whose max output isn't known can't be
+	// reserved.
+	c = newTestCounter(t, "my-own-model")
+	if _, err := budget.Reserve("acme", c, req); err == nil {
+		t.Error("Reserve: got nil error for a model without a max output")
+	}
+	req.MaxTokens = 100
+	if _, err := budget.Reserve("acme", c, req); err != nil {
+		t.Errorf("Reserve with max_tokens: %v", err)
+	}
+}
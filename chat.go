@@ -0,0 +1,579 @@
+package tokens
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+// chatRequest is a chat request independent of the client library it came
+// from. All counting is done on this representation; the adapters below build
+// it from go-openai types and from the OpenAI wire format.
+type chatRequest struct {
+	messages       []chatMessage
+	tools          []toolDef
+	toolChoice     toolChoice
+	responseFormat *responseFormat
+	// prediction is the text of the predicted output, if any.
+	prediction string
+	// maxTokens and n bound the completion. maxTokens is 0 when unset.
+	maxTokens int
+	n         int
+}
+
+type chatMessage struct {
+	role       string
+	name       string
+	parts      []contentPart
+	toolCalls  []toolCall
+	toolCallID string
+}
+
+// text returns the message's text parts joined together.
+func (m chatMessage) text() string {
+	var text string
+	for _, p := range m.parts {
+		if p.kind == partText {
+			text += p.text
+		}
+	}
+	return text
+}
+
+type partKind int
+
+const (
+	partText partKind = iota
+	partImage
+	partAudio
+)
+
+type contentPart struct {
+	kind        partKind
+	text        string
+	imageURL    string
+	imageDetail string
+	audioData   string
+	audioFormat string
+}
+
+type toolCall struct {
+	id        string
+	name      string
+	arguments string
+}
+
+type toolDef struct {
+	name        string
+	description string
+	parameters  map[string]interface{}
+	// path is where the definition is in the request, e.g. tools[1].function
+	// or functions[0], for reporting issues with it.
+	path string
+}
+
+// responseFormat is a JSON schema the response must follow.
+type responseFormat struct {
+	name        string
+	description string
+	schema      map[string]interface{}
+}
+
+// toolChoice is the request's tool_choice. A function choice has a name;
+// otherwise mode is "none", "auto", "required" or, if unset, "".
+type toolChoice struct {
+	mode string
+	name string
+}
+
+const (
+	toolChoiceNone     = "none"
+	toolChoiceAuto     = "auto"
+	toolChoiceRequired = "required"
+	toolChoiceFunction = "function"
+)
+
+// fromOpenAI converts a go-openai request.
+func fromOpenAI(req openai.ChatCompletionRequest) chatRequest {
+	r := chatRequest{
+		messages:   make([]chatMessage, len(req.Messages)),
+		tools:      toolDefsFromOpenAI(req.Tools),
+		toolChoice: toolChoiceFromOpenAI(req.ToolChoice),
+		maxTokens:  req.MaxTokens,
+		n:          req.N,
+	}
+	for i, m := range req.Messages {
+		r.messages[i] = messageFromOpenAI(m)
+	}
+	// Functions are the deprecated form of tools, and are rendered the same
+	// way.
+	for i, function := range req.Functions {
+		def, _ := toolDefFromOpenAI(function)
+		def.path = fmt.Sprintf("functions[%d]", i)
+		r.tools = append(r.tools, def)
+	}
+	if r.toolChoice == (toolChoice{}) {
+		r.toolChoice = toolChoiceFromOpenAI(req.FunctionCall)
+	}
+	return r
+}
+
+func messageFromOpenAI(m openai.ChatCompletionMessage) chatMessage {
+	msg := chatMessage{
+		role:       m.Role,
+		name:       m.Name,
+		toolCallID: m.ToolCallID,
+	}
+
+	if len(m.MultiContent) > 0 {
+		for _, p := range m.MultiContent {
+			switch p.Type {
+			case openai.ChatMessagePartTypeImageURL:
+				part := contentPart{kind: partImage}
+				if p.ImageURL != nil {
+					part.imageURL = p.ImageURL.URL
+					part.imageDetail = string(p.ImageURL.Detail)
+				}
+				msg.parts = append(msg.parts, part)
+			default:
+				msg.parts = append(msg.parts, contentPart{kind: partText, text: p.Text})
+			}
+		}
+	} else {
+		msg.parts = []contentPart{{kind: partText, text: m.Content}}
+	}
+
+	for _, tc := range m.ToolCalls {
+		msg.toolCalls = append(msg.toolCalls, toolCall{
+			id:        tc.ID,
+			name:      tc.Function.Name,
+			arguments: tc.Function.Arguments,
+		})
+	}
+	if fc := m.FunctionCall; fc != nil {
+		msg.toolCalls = append(msg.toolCalls, toolCall{name: fc.Name, arguments: fc.Arguments})
+	}
+
+	return msg
+}
+
+func toolDefsFromOpenAI(tools []openai.Tool) []toolDef {
+	var defs []toolDef
+	for i, tool := range tools {
+		if tool.Function == nil {
+			continue
+		}
+		def, _ := toolDefFromOpenAI(*tool.Function)
+		def.path = fmt.Sprintf("tools[%d].function", i)
+		defs = append(defs, def)
+	}
+	return defs
+}
+
+// toolDefFromOpenAI converts a function definition. When its parameters
+// can't be converted to a JSON object the definition is still returned,
+// without parameters, along with the error.
+func toolDefFromOpenAI(function openai.FunctionDefinition) (toolDef, error) {
+	def := toolDef{
+		name:        function.Name,
+		description: function.Description,
+	}
+	// Parameters may be any type that marshals to a JSON schema.
+	paramsJSON, err := json.Marshal(function.Parameters)
+	if err != nil {
+		return def, err
+	}
+	if err := json.Unmarshal(paramsJSON, &def.parameters); err != nil {
+		return def, errors.New("parameters must be a JSON object")
+	}
+	return def, nil
+}
+
+func toolChoiceFromOpenAI(choice any) toolChoice {
+	switch t := choice.(type) {
+	case openai.ToolChoice:
+		return toolChoice{mode: toolChoiceFunction, name: t.Function.Name}
+	case *openai.ToolChoice:
+		if t == nil {
+			return toolChoice{}
+		}
+		return toolChoice{mode: toolChoiceFunction, name: t.Function.Name}
+	case string:
+		return toolChoice{mode: t}
+	case map[string]interface{}:
+		// A tool choice decoded from JSON.
+		b, _ := json.Marshal(t)
+		choice, _ := toolChoiceFromWire(b)
+		return choice
+	case json.RawMessage:
+		choice, _ := toolChoiceFromWire(t)
+		return choice
+	case nil:
+		return toolChoice{}
+	default:
+		// Anything else that marshals to a tool choice, such as the
+		// openai.FunctionCall naming a function in a function_call.
+		b, err := json.Marshal(t)
+		if err != nil {
+			return toolChoice{}
+		}
+		choice, _ := toolChoiceFromWire(b)
+		return choice
+	}
+}
+
+// RequestError reports a malformed request. Path locates the invalid value,
+// such as "messages[2].content", and is empty when the request isn't valid
+// JSON at all.
+type RequestError struct {
+	Path string
+	Err  error
+}
+
+func (e *RequestError) Error() string {
+	if e.Path == "" {
+		return fmt.Sprintf("invalid request: %v", e.Err)
+	}
+	return fmt.Sprintf("invalid request: %s: %v", e.Path, e.Err)
+}
+
+func (e *RequestError) Unwrap() error {
+	return e.Err
+}
+
+// wireRequest is the subset of the OpenAI chat completions wire format that
+// affects the prompt or bounds the completion, including fields go-openai
+// doesn't model.
+type wireRequest struct {
+	Model          string              `json:"model"`
+	Messages       []wireMessage       `json:"messages"`
+	Tools          []wireTool          `json:"tools"`
+	ToolChoice     json.RawMessage     `json:"tool_choice"`
+	Functions      []wireFunction      `json:"functions"`
+	FunctionCall   json.RawMessage     `json:"function_call"`
+	ResponseFormat *wireResponseFormat `json:"response_format"`
+	Prediction     *wirePrediction     `json:"prediction"`
+	MaxTokens      int                 `json:"max_tokens"`
+	// MaxCompletionTokens replaces max_tokens for newer models.
+	MaxCompletionTokens int `json:"max_completion_tokens"`
+	N                   int `json:"n"`
+}
+
+type wirePrediction struct {
+	Type    string          `json:"type"`
+	Content json.RawMessage `json:"content"`
+}
+
+type wireMessage struct {
+	Role         string            `json:"role"`
+	Content      json.RawMessage   `json:"content"`
+	Name         string            `json:"name"`
+	Refusal      string            `json:"refusal"`
+	ToolCalls    []wireToolCall    `json:"tool_calls"`
+	FunctionCall *wireFunctionCall `json:"function_call"`
+	ToolCallID   string            `json:"tool_call_id"`
+}
+
+type wirePart struct {
+	Type     string `json:"type"`
+	Text     string `json:"text"`
+	Refusal  string `json:"refusal"`
+	ImageURL *struct {
+		URL    string `json:"url"`
+		Detail string `json:"detail"`
+	} `json:"image_url"`
+	InputAudio *struct {
+		Data   string `json:"data"`
+		Format string `json:"format"`
+	} `json:"input_audio"`
+}
+
+type wireToolCall struct {
+	ID       string           `json:"id"`
+	Function wireFunctionCall `json:"function"`
+}
+
+type wireFunctionCall struct {
+	Name      string `json:"name"`
+	Arguments string `json:"arguments"`
+}
+
+type wireTool struct {
+	Type     string        `json:"type"`
+	Function *wireFunction `json:"function"`
+}
+
+type wireFunction struct {
+	Name        string                 `json:"name"`
+	Description string                 `json:"description"`
+	Parameters  map[string]interface{} `json:"parameters"`
+}
+
+type wireResponseFormat struct {
+	Type       string `json:"type"`
+	JSONSchema *struct {
+		Name        string                 `json:"name"`
+		Description string                 `json:"description"`
+		Schema      map[string]interface{} `json:"schema"`
+	} `json:"json_schema"`
+}
+
+// CountRequestJSON returns the number of tokens in a chat completion request
+// body in the OpenAI wire format. The body is parsed directly, without
+// go-openai, so fields go-openai doesn't model, such as JSON schema response
+// formats and refusals, are counted too. Malformed requests return a
+// *RequestError.
+func (c *Counter) CountRequestJSON(body []byte) (int, error) {
+	r, err := fromJSON(body)
+	if err != nil {
+		return 0, err
+	}
+	return len(c.render(r).tokens), nil
+}
+
+// fromJSON converts a request in the OpenAI wire format.
+func fromJSON(b []byte) (chatRequest, error) {
+	var req wireRequest
+	if err := json.Unmarshal(b, &req); err != nil {
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &typeErr) {
+			return chatRequest{}, &RequestError{Path: typeErr.Field, Err: err}
+		}
+		return chatRequest{}, &RequestError{Err: err}
+	}
+
+	var r chatRequest
+	for i, m := range req.Messages {
+		msg, err := messageFromWire(m)
+		if err != nil {
+			return chatRequest{}, &RequestError{Path: fmt.Sprintf("messages[%d].content", i), Err: err}
+		}
+		r.messages = append(r.messages, msg)
+	}
+
+	for i, tool := range req.Tools {
+		if tool.Function == nil {
+			continue
+		}
+		r.tools = append(r.tools, tool.Function.toolDef(fmt.Sprintf("tools[%d].function", i)))
+	}
+	// Functions are the deprecated form of tools, and are rendered the same
+	// way.
+	for i, function := range req.Functions {
+		r.tools = append(r.tools, function.toolDef(fmt.Sprintf("functions[%d]", i)))
+	}
+
+	choice, err := toolChoiceFromWire(req.ToolChoice)
+	if err != nil {
+		return chatRequest{}, &RequestError{Path: "tool_choice", Err: err}
+	}
+	if choice == (toolChoice{}) {
+		if choice, err = toolChoiceFromWire(req.FunctionCall); err != nil {
+			return chatRequest{}, &RequestError{Path: "function_call", Err: err}
+		}
+	}
+	r.toolChoice = choice
+
+	if req.Prediction != nil {
+		parts, err := partsFromWire(req.Prediction.Content)
+		if err != nil {
+			return chatRequest{}, &RequestError{Path: "prediction.content", Err: err}
+		}
+		r.prediction = chatMessage{parts: parts}.text()
+	}
+	r.maxTokens, r.n = req.MaxTokens, req.N
+	if req.MaxCompletionTokens > 0 {
+		r.maxTokens = req.MaxCompletionTokens
+	}
+
+	if f := req.ResponseFormat; f != nil && f.Type == "json_schema" && f.JSONSchema != nil {
+		r.responseFormat = &responseFormat{
+			name:        f.JSONSchema.Name,
+			description: f.JSONSchema.Description,
+			schema:      f.JSONSchema.Schema,
+		}
+	}
+
+	return r, nil
+}
+
+func (f wireFunction) toolDef(path string) toolDef {
+	return toolDef{
+		name:        f.Name,
+		description: f.Description,
+		parameters:  f.Parameters,
+		path:        path,
+	}
+}
+
+func messageFromWire(m wireMessage) (chatMessage, error) {
+	msg := chatMessage{
+		role:       m.Role,
+		name:       m.Name,
+		toolCallID: m.ToolCallID,
+	}
+
+	parts, err := partsFromWire(m.Content)
+	if err != nil {
+		return chatMessage{}, err
+	}
+	msg.parts = parts
+	if m.Refusal != "" {
+		msg.parts = append(msg.parts, contentPart{kind: partText, text: m.Refusal})
+	}
+
+	for _, tc := range m.ToolCalls {
+		msg.toolCalls = append(msg.toolCalls, toolCall{
+			id:        tc.ID,
+			name:      tc.Function.Name,
+			arguments: tc.Function.Arguments,
+		})
+	}
+	if fc := m.FunctionCall; fc != nil {
+		msg.toolCalls = append(msg.toolCalls, toolCall{name: fc.Name, arguments: fc.Arguments})
+	}
+
+	return msg, nil
+}
+
+// partsFromWire converts message content, which is a string, an array of
+// content parts or null.
+func partsFromWire(content json.RawMessage) ([]contentPart, error) {
+	if len(content) == 0 || string(content) == "null" {
+		return []contentPart{{kind: partText}}, nil
+	}
+
+	var text string
+	if err := json.Unmarshal(content, &text); err == nil {
+		return []contentPart{{kind: partText, text: text}}, nil
+	}
+
+	var wireParts []wirePart
+	if err := json.Unmarshal(content, &wireParts); err != nil {
+		return nil, errors.New("must be a string or an array of content parts")
+	}
+	var parts []contentPart
+	for _, p := range wireParts {
+		switch p.Type {
+		case "image_url":
+			part := contentPart{kind: partImage}
+			if p.ImageURL != nil {
+				part.imageURL = p.ImageURL.URL
+				part.imageDetail = p.ImageURL.Detail
+			}
+			parts = append(parts, part)
+		case "input_audio":
+			part := contentPart{kind: partAudio}
+			if p.InputAudio != nil {
+				part.audioData = p.InputAudio.Data
+				part.audioFormat = p.InputAudio.Format
+			}
+			parts = append(parts, part)
+		case "refusal":
+			parts = append(parts, contentPart{kind: partText, text: p.Refusal})
+		default:
+			parts = append(parts, contentPart{kind: partText, text: p.Text})
+		}
+	}
+
+	return parts, nil
+}
+
+func toolChoiceFromWire(raw json.RawMessage) (toolChoice, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return toolChoice{}, nil
+	}
+
+	var mode string
+	if err := json.Unmarshal(raw, &mode); err == nil {
+		return toolChoice{mode: mode}, nil
+	}
+
+	// The deprecated function_call names the function directly.
+	var choice struct {
+		Type     string `json:"type"`
+		Name     string `json:"name"`
+		Function struct {
+			Name string `json:"name"`
+		} `json:"function"`
+	}
+	if err := json.Unmarshal(raw, &choice); err != nil {
+		return toolChoice{}, errors.New("must be a string or an object")
+	}
+	if choice.Function.Name == "" {
+		return toolChoice{mode: toolChoiceFunction, name: choice.Name}, nil
+	}
+	return toolChoice{mode: toolChoiceFunction, name: choice.Function.Name}, nil
+}
+
+// ChatRequest is an openai.ChatCompletionRequest with the parameters that
+// affect the prompt but go-openai doesn't model yet. It marshals to the wire
+// format, and can be counted with CountChatRequest.
+type ChatRequest struct {
+	openai.ChatCompletionRequest
+	// Prediction is a predicted output, which speeds up completions that
+	// mostly repeat known text, such as a file being edited.
+	Prediction *Prediction `json:"prediction,omitempty"`
+}
+
+// Prediction is the predicted output of a chat completion request.
+type Prediction struct {
+	// Type is always "content".
+	Type    string `json:"type"`
+	Content string `json:"content"`
+}
+
+func fromChatRequest(req ChatRequest) chatRequest {
+	r := fromOpenAI(req.ChatCompletionRequest)
+	if req.Prediction != nil {
+		r.prediction = req.Prediction.Content
+	}
+	return r
+}
+
+// CountChatRequest returns the number of tokens in a chat completion request
+// given in any form the package understands: an openai.ChatCompletionRequest,
+// a ChatRequest or a pointer to either, the OpenAI wire format as []byte or json.RawMessage,
+// or any other value that marshals to the wire format, such as the request
+// parameters of the official openai-go SDK. This lets callers that don't use
+// go-openai count requests without converting them.
+func (c *Counter) CountChatRequest(req any) (int, error) {
+	r, err := chatRequestFrom(req)
+	if err != nil {
+		return 0, err
+	}
+	return len(c.render(r).tokens), nil
+}
+
+func chatRequestFrom(req any) (chatRequest, error) {
+	switch r := req.(type) {
+	case openai.ChatCompletionRequest:
+		return fromOpenAI(r), nil
+	case *openai.ChatCompletionRequest:
+		if r == nil {
+			return chatRequest{}, &RequestError{Err: errors.New("nil request")}
+		}
+		return fromOpenAI(*r), nil
+	case ChatRequest:
+		return fromChatRequest(r), nil
+	case *ChatRequest:
+		if r == nil {
+			return chatRequest{}, &RequestError{Err: errors.New("nil request")}
+		}
+		return fromChatRequest(*r), nil
+	case json.RawMessage:
+		return fromJSON(r)
+	case []byte:
+		return fromJSON(r)
+	default:
+		// The openai-go SDK, and most other clients, marshal their request
+		// types to the wire format.
+		b, err := json.Marshal(req)
+		if err != nil {
+			return chatRequest{}, fmt.Errorf("unsupported request %T: %w", req, err)
+		}
+		return fromJSON(b)
+	}
+}
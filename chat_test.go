@@ -0,0 +1,348 @@
+package tokens
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"image"
+	"image/png"
+	"testing"
+
+	"github.com/sashabaranov/go-openai"
+	"github.com/sashabaranov/go-openai/jsonschema"
+)
+
+// wireParams stands in for another client's request type, which marshals to
+// the wire format.
+type wireParams struct {
+	raw string
+}
+
+func (p wireParams) MarshalJSON() ([]byte, error) {
+	return []byte(p.raw), nil
+}
+
+func TestCountChatRequest(t *testing.T) {
+	c := newTestCounter(t, openai.GPT4o)
+
+	req := openai.ChatCompletionRequest{
+		Model: openai.GPT4o,
+		Messages: []openai.ChatCompletionMessage{{
+			Role:    openai.ChatMessageRoleUser,
+			Content: "Weather in Vail?",
+		}, {
+			Role: openai.ChatMessageRoleAssistant,
+			ToolCalls: []openai.ToolCall{{
+				ID:       "call_1",
+				Type:     openai.ToolTypeFunction,
+				Function: openai.FunctionCall{Name: "get_current_weather", Arguments: `{"location":"Vail, CO"}`},
+			}},
+		}, {
+			Role:       openai.ChatMessageRoleTool,
+			Content:    `{"forecast":"Sunny"}`,
+			ToolCallID: "call_1",
+		}},
+		Tools: []openai.Tool{{
+			Type: openai.ToolTypeFunction,
+			Function: &openai.FunctionDefinition{
+				Name: "get_current_weather",
+				Parameters: jsonschema.Definition{
+					Type: jsonschema.Object,
+					Properties: map[string]jsonschema.Definition{
+						"location": {Type: jsonschema.String, Description: "The city and state."},
+					},
+					Required: []string{"location"},
+				},
+			},
+		}},
+		ToolChoice: openai.ToolChoice{
+			Type:     openai.ToolTypeFunction,
+			Function: openai.ToolFunction{Name: "get_current_weather"},
+		},
+	}
+	want := c.CountRequestTokens(req)
+
+	raw, err := json.Marshal(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		req  any
+	}{
+		{name: "Request", req: req},
+		{name: "Request pointer", req: &req},
+		{name: "JSON", req: raw},
+		{name: "Raw message", req: json.RawMessage(raw)},
+		{name: "Marshaler", req: wireParams{raw: string(raw)}},
+	}
+	for _, tt := range tests {
+		got, err := c.CountChatRequest(tt.req)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if got != want {
+			t.Errorf("%s: got %d, want %d", tt.name, got, want)
+		}
+	}
+
+	// Content parts count the same as the equivalent string content.
+	parts := `{"messages":[{"role":"user","content":[{"type":"text","text":"Weather "},{"type":"text","text":"in Vail?"}]}]}`
+	text := `{"messages":[{"role":"user","content":"Weather in Vail?"}]}`
+	gotParts, err := c.CountChatRequest([]byte(parts))
+	if err != nil {
+		t.Fatalf("content parts: %v", err)
+	}
+	if wantText, _ := c.CountChatRequest([]byte(text)); gotParts != wantText {
+		t.Errorf("content parts: got %d, want %d", gotParts, wantText)
+	}
+
+	if _, err := c.CountChatRequest([]byte(`{"messages":[{"role":"user","content":42}]}`)); err == nil {
+		t.Errorf("invalid content: got nil error")
+	}
+}
+
+func TestImageTokens(t *testing.T) {
+	dataURL := func(w, h int) string {
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, image.NewGray(image.Rect(0, 0, w, h))); err != nil {
+			t.Fatal(err)
+		}
+		return "data:image/png;base64," + base64.StdEncoding.EncodeToString(buf.Bytes())
+	}
+
+	tests := []struct {
+		name   string
+		model  string
+		url    string
+		detail string
+		want   int
+	}{
+		{name: "Low detail", model: openai.GPT4o, url: dataURL(4096, 4096), detail: "low", want: 85},
+		// Scaled to 768x768, 4 tiles.
+		{name: "Square", model: openai.GPT4o, url: dataURL(1024, 1024), want: 85 + 170*4},
+		// Scaled to 2048x1024, then 1536x768, 6 tiles.
+		{name: "Wide", model: openai.GPT4o, url: dataURL(4096, 2048), want: 85 + 170*6},
+		{name: "Small", model: openai.GPT4o, url: dataURL(100, 100), want: 85 + 170},
+		{name: "Remote", model: openai.GPT4o, url: "https://example.com/a.png", want: 85 + 170*8},
+		{name: "Mini", model: "gpt-4o-mini-2024-07-18", url: dataURL(100, 100), want: 2833 + 5667},
+	}
+	for _, tt := range tests {
+		c := newTestCounter(t, tt.model)
+		if got := c.imageTokens(tt.url, tt.detail); got != tt.want {
+			t.Errorf("%s: got %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestCountRequestJSON(t *testing.T) {
+	c := newTestCounter(t, openai.GPT4o)
+
+	count := func(body string) int {
+		t.Helper()
+		n, err := c.CountRequestJSON([]byte(body))
+		if err != nil {
+			t.Fatalf("CountRequestJSON(%s): %v", body, err)
+		}
+		return n
+	}
+
+	// A JSON schema response format is rendered into the system message.
+	plain := count(`{"messages":[{"role":"system","content":"Be brief."}]}`)
+	withFormat := count(`{"messages":[{"role":"system","content":"Be brief."}],` +
+		`"response_format":{"type":"json_schema","json_schema":{"name":"answer","schema":{"type":"object"}}}}`)
+	block := "\n\n# Response Formats\n\n## answer\n\n" + `{"type":"object"}`
+	if got, want := withFormat-plain, len(block); got != want {
+		t.Errorf("response format: got %d more tokens, want %d", got, want)
+	}
+
+	// Refusals in assistant history are counted as text.
+	if got, want := count(`{"messages":[{"role":"assistant","content":null,"refusal":"No."}]}`),
+		count(`{"messages":[{"role":"assistant","content":"No."}]}`); got != want {
+		t.Errorf("refusal: got %d, want %d", got, want)
+	}
+
+	// Deprecated functions count the same as tools.
+	if got, want := count(`{"messages":[],"functions":[{"name":"f"}],"function_call":{"name":"f"}}`),
+		count(`{"messages":[],"tools":[{"type":"function","function":{"name":"f"}}],"tool_choice":{"type":"function","function":{"name":"f"}}}`); got != want {
+		t.Errorf("functions: got %d, want %d", got, want)
+	}
+
+	tests := []struct {
+		body     string
+		wantPath string
+	}{
+		{body: `{"messages":`, wantPath: ""},
+		{body: `{"messages":{}}`, wantPath: "messages"},
+		{body: `{"messages":[{"role":"user"},{"role":"user","content":true}]}`, wantPath: "messages[1].content"},
+		{body: `{"messages":[],"tool_choice":1}`, wantPath: "tool_choice"},
+	}
+	for _, tt := range tests {
+		_, err := c.CountRequestJSON([]byte(tt.body))
+		var reqErr *RequestError
+		if !errors.As(err, &reqErr) {
+			t.Errorf("%s: got %v, want a *RequestError", tt.body, err)
+			continue
+		}
+		if reqErr.Path != tt.wantPath {
+			t.Errorf("%s: got path %q, want %q", tt.body, reqErr.Path, tt.wantPath)
+		}
+	}
+}
+
+func TestCountRequestJSONParity(t *testing.T) {
+	c := newTestCounter(t, openai.GPT4o)
+
+	// The deprecated functions API, which go-openai still models.
+	req := openai.ChatCompletionRequest{
+		Model: openai.GPT4o,
+		Messages: []openai.ChatCompletionMessage{{
+			Role:    openai.ChatMessageRoleUser,
+			Content: "Weather in Vail?",
+		}, {
+			Role:         openai.ChatMessageRoleAssistant,
+			FunctionCall: &openai.FunctionCall{Name: "get_current_weather", Arguments: `{"location":"Vail, CO"}`},
+		}, {
+			Role:    openai.ChatMessageRoleFunction,
+			Name:    "get_current_weather",
+			Content: `{"forecast":"Sunny"}`,
+		}},
+		Functions: []openai.FunctionDefinition{{
+			Name:        "get_current_weather",
+			Description: "Get the current weather.",
+			Parameters: jsonschema.Definition{
+				Type: jsonschema.Object,
+				Properties: map[string]jsonschema.Definition{
+					"location": {Type: jsonschema.String},
+				},
+			},
+		}},
+	}
+
+	for name, functionCall := range map[string]any{
+		"named":  openai.FunctionCall{Name: "get_current_weather"},
+		"map":    map[string]interface{}{"name": "get_current_weather"},
+		"auto":   "auto",
+		"none":   "none",
+		"absent": nil,
+	} {
+		req.FunctionCall = functionCall
+		raw, err := json.Marshal(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, err := c.CountRequestJSON(raw)
+		if err != nil {
+			t.Fatalf("%s: CountRequestJSON: %v", name, err)
+		}
+		if got := c.CountRequestTokens(req); got != want {
+			t.Errorf("%s: CountRequestTokens got %d, CountRequestJSON %d", name, got, want)
+		}
+	}
+}
+
+func TestToolChoiceForms(t *testing.T) {
+	c := newTestCounter(t, openai.GPT4o)
+
+	req := openai.ChatCompletionRequest{
+		Messages: []openai.ChatCompletionMessage{{Role: openai.ChatMessageRoleUser, Content: "Hi"}},
+		Tools:    skiWeatherTools,
+	}
+	if base := c.CountRequestTokens(req); base != 275 {
+		t.Fatalf("no tool choice: got %d tokens, want 275", base)
+	}
+
+	// A named function renders `{\n "name": "get_current_weather"\n}`, 34
+	// tokens with the test tokenizer.
+	tests := []struct {
+		name   string
+		choice any
+		want   int
+	}{
+		{name: "Auto", choice: "auto", want: 275},
+		{name: "None", choice: "none", want: 276},
+		{name: "Required", choice: "required", want: 275},
+		{name: "Struct", choice: openai.ToolChoice{
+			Type:     openai.ToolTypeFunction,
+			Function: openai.ToolFunction{Name: "get_current_weather"},
+		}, want: 309},
+		{name: "Pointer", choice: &openai.ToolChoice{
+			Type:     openai.ToolTypeFunction,
+			Function: openai.ToolFunction{Name: "get_current_weather"},
+		}, want: 309},
+		{name: "Map", choice: map[string]interface{}{
+			"type":     "function",
+			"function": map[string]interface{}{"name": "get_current_weather"},
+		}, want: 309},
+	}
+	for _, tt := range tests {
+		req.ToolChoice = tt.choice
+		got := c.CountRequestTokens(req)
+		if got != tt.want {
+			t.Errorf("%s: got %d tokens, want %d", tt.name, got, tt.want)
+		}
+
+		raw, _ := json.Marshal(req)
+		if gotJSON, err := c.CountRequestJSON(raw); err != nil || gotJSON != got {
+			t.Errorf("%s: CountRequestJSON got %d, %v, want %d", tt.name, gotJSON, err, got)
+		}
+	}
+}
+
+func TestParallelToolCalls(t *testing.T) {
+	c := newTestCounter(t, openai.GPT4o)
+
+	call := func(id, location string) openai.ToolCall {
+		return openai.ToolCall{
+			ID:       id,
+			Type:     openai.ToolTypeFunction,
+			Function: openai.FunctionCall{Name: "get_current_weather", Arguments: `{"location":"` + location + `"}`},
+		}
+	}
+	a, b, s := call("call_a", "Killington, VT"), call("call_b", "Mount Tremblant, QC"), call("call_s", "Stowe, VT")
+
+	// The role, the wrapper's separators and name, and its tool_uses JSON,
+	// which grows with every call.
+	tests := []struct {
+		name  string
+		calls []openai.ToolCall
+		want  int
+	}{
+		{name: "Two calls", calls: []openai.ToolCall{a, b}, want: 9 + 8 + 23 + 208},
+		{name: "Three calls", calls: []openai.ToolCall{a, b, s}, want: 9 + 8 + 23 + 297},
+	}
+	for _, tt := range tests {
+		got := c.CountMessageTokens(openai.ChatCompletionMessage{
+			Role:      openai.ChatMessageRoleAssistant,
+			ToolCalls: tt.calls,
+		})
+		if got != tt.want {
+			t.Errorf("%s: got %d, want %d", tt.name, got, tt.want)
+		}
+	}
+
+	// Each parallel message is wrapped, however many there are.
+	req := openai.ChatCompletionRequest{
+		Messages: []openai.ChatCompletionMessage{
+			{Role: openai.ChatMessageRoleAssistant, ToolCalls: []openai.ToolCall{a, b}},
+			{Role: openai.ChatMessageRoleTool, Content: "45", ToolCallID: "call_a"},
+			{Role: openai.ChatMessageRoleTool, Content: "32", ToolCallID: "call_b"},
+		},
+		Tools: skiWeatherTools,
+	}
+	once := c.CountRequestTokens(req)
+	req.Messages = append(req.Messages, req.Messages...)
+	if twice := c.CountRequestTokens(req); twice != 2*once-c.CountRequestTokens(openai.ChatCompletionRequest{Tools: skiWeatherTools}) {
+		t.Errorf("two parallel rounds: got %d, want twice the messages of %d", twice, once)
+	}
+
+	conv := c.NewConversation()
+	conv.SetTools(skiWeatherTools)
+	conv.Append(req.Messages...)
+	if got, want := conv.CountTokens(), c.CountRequestTokens(req); got != want {
+		t.Errorf("conversation: got %d, want %d", got, want)
+	}
+}
@@ -0,0 +1,272 @@
+package tokens
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+var (
+	// A completion's role and the tokens around its content aren't billed,
+	// but each tool call it makes is: the recipient, "functions." and the
+	// function's name, and the separators around the arguments add
+	// tokensPerCompletionToolCall tokens to the name and arguments. This is
+	// an estimate, fitted to only the "Single complete message with tool
+	// call" case of TestCountResponseTokens, 40 completion tokens.
+	tokensPerCompletionToolCall = 6
+	// Parallel tool calls are made as one call to multi_tool_use.parallel,
+	// with the calls as the JSON of its tool_uses, which costs
+	// tokensForParallelWrapper tokens of separators on top of the wrapper's
+	// name and JSON. Assistant messages in the history with more than one
+	// tool call are rendered the same way. This is an estimate, fitted to
+	// only the "Single complete message with tool call - variant" and
+	// "Single complete message with two tool calls" cases of
+	// TestCountResponseTokens, 62 and 90 completion tokens.
+	tokensForParallelWrapper = 8
+)
+
+// ChoiceTokens is the completion tokens of one choice of a response.
+type ChoiceTokens struct {
+	Index        int    `json:"index"`
+	FinishReason string `json:"finish_reason"`
+	Tokens       int    `json:"tokens"`
+	// Exact is true when Tokens is known rather than counted: a choice cut
+	// off by max_tokens generated exactly that many.
+	Exact bool `json:"exact"`
+}
+
+type wireChoice struct {
+	Index        int         `json:"index"`
+	Message      wireMessage `json:"message"`
+	FinishReason string      `json:"finish_reason"`
+}
+
+// choice is a choice of a response independent of the form it was given in.
+type choice struct {
+	index        int
+	finishReason string
+	message      chatMessage
+}
+
+// CountChoiceTokens returns the completion tokens of each choice of a chat
+// completion response, given as an openai.ChatCompletionResponse or a
+// pointer to one, as JSON or as any value that marshals to it. Refusals count
+// like content. Choices with finish_reason "length" used all of
+// req.MaxTokens, when it's set. Tool calls are estimated as for
+// CountResponseTokens.
+func (c *Counter) CountChoiceTokens(
+	req openai.ChatCompletionRequest,
+	resp any,
+) ([]ChoiceTokens, error) {
+	switch r := resp.(type) {
+	case openai.ChatCompletionResponse:
+		return c.countChoices(req, choicesFromOpenAI(r)), nil
+	case *openai.ChatCompletionResponse:
+		if r != nil {
+			return c.countChoices(req, choicesFromOpenAI(*r)), nil
+		}
+	}
+
+	b, err := wireJSON(resp)
+	if err != nil {
+		return nil, err
+	}
+
+	var wire struct {
+		Choices []wireChoice `json:"choices"`
+	}
+	if err := json.Unmarshal(b, &wire); err != nil {
+		return nil, &RequestError{Err: err}
+	}
+
+	choices := make([]choice, len(wire.Choices))
+	for i, ch := range wire.Choices {
+		m, err := messageFromWire(ch.Message)
+		if err != nil {
+			return nil, &RequestError{Path: fmt.Sprintf("choices[%d].message.content", i), Err: err}
+		}
+		choices[i] = choice{index: ch.Index, finishReason: ch.FinishReason, message: m}
+	}
+
+	return c.countChoices(req, choices), nil
+}
+
+// choicesFromOpenAI converts the choices of a go-openai response directly,
+// since one with both Content and MultiContent set doesn't marshal.
+func choicesFromOpenAI(resp openai.ChatCompletionResponse) []choice {
+	choices := make([]choice, len(resp.Choices))
+	for i, ch := range resp.Choices {
+		choices[i] = choice{
+			index:        ch.Index,
+			finishReason: string(ch.FinishReason),
+			message:      messageFromOpenAI(ch.Message),
+		}
+	}
+	return choices
+}
+
+func (c *Counter) countChoices(req openai.ChatCompletionRequest, choices []choice) []ChoiceTokens {
+	counts := make([]ChoiceTokens, len(choices))
+	for i, ch := range choices {
+		counts[i] = ChoiceTokens{Index: ch.index, FinishReason: ch.finishReason}
+
+		if ch.finishReason == string(openai.FinishReasonLength) && req.MaxTokens > 0 {
+			counts[i].Tokens, counts[i].Exact = req.MaxTokens, true
+			continue
+		}
+		counts[i].Tokens = len(c.encodeCompletion(ch.message))
+	}
+	return counts
+}
+
+// CountCompletionTokens returns the completion tokens of all the choices of
+// a chat completion response, which is what Usage.CompletionTokens reports
+// when req.N asks for more than one.
+func (c *Counter) CountCompletionTokens(
+	req openai.ChatCompletionRequest,
+	resp any,
+) (int, error) {
+	choices, err := c.CountChoiceTokens(req, resp)
+	if err != nil {
+		return 0, err
+	}
+	return sumChoiceTokens(choices), nil
+}
+
+func sumChoiceTokens(choices []ChoiceTokens) int {
+	var count int
+	for _, choice := range choices {
+		count += choice.Tokens
+	}
+	return count
+}
+
+// MaxChatCompletionTokens returns the most completion tokens a chat
+// completion request can be billed for: N choices of up to MaxTokens each,
+// or 0 when MaxTokens isn't set. Prompt tokens are billed once however many
+// choices there are.
+func MaxChatCompletionTokens(req openai.ChatCompletionRequest) int {
+	n := req.N
+	if n < 1 {
+		n = 1
+	}
+	return n * req.MaxTokens
+}
+
+// maxOutputTokens returns the most tokens a choice can be generated with:
+// maxTokens, or the model's max output tokens when it isn't set.
+func (c *Counter) maxOutputTokens(maxTokens int) (int, error) {
+	if maxTokens > 0 {
+		return maxTokens, nil
+	}
+	output, ok := MaxOutputTokensFor(c.model)
+	if !ok {
+		return 0, fmt.Errorf("no max_tokens set and no max output tokens known for model %q", c.model)
+	}
+	return output, nil
+}
+
+// encodeCompletion returns the tokens of a message as the model generated
+// it: its content and its tool calls, without the role.
+func (c *Counter) encodeCompletion(message chatMessage) []int {
+	var tokens []int
+	for _, part := range message.parts {
+		tokens = append(tokens, c.encode(part.text)...)
+	}
+
+	calls := message.toolCalls
+	if len(calls) == 0 {
+		return tokens
+	}
+
+	if len(calls) > 1 || wrappedArguments(calls[0].arguments) {
+		if wrapper, ok := c.encodeParallelWrapper(calls); ok {
+			return append(tokens, wrapper...)
+		}
+	}
+
+	for _, tc := range calls {
+		tokens = append(tokens, overheadTokens(tokensPerCompletionToolCall)...)
+		tokens = append(tokens, c.encode("functions."+tc.name)...)
+		tokens = append(tokens, c.encode(tc.arguments)...)
+	}
+	return tokens
+}
+
+// encodeParallelWrapper encodes tool calls as the one call to
+// multi_tool_use.parallel they're made through, so its cost grows with the
+// calls' names and arguments. It returns false if any call's arguments
+// aren't JSON, since those can't have come from the wrapper.
+func (c *Counter) encodeParallelWrapper(calls []toolCall) ([]int, bool) {
+	type toolUse struct {
+		RecipientName string          `json:"recipient_name"`
+		Parameters    json.RawMessage `json:"parameters"`
+	}
+	uses := make([]toolUse, len(calls))
+	for i, tc := range calls {
+		uses[i] = toolUse{RecipientName: "functions." + tc.name, Parameters: compactArguments(tc.arguments)}
+	}
+	var wrapper bytes.Buffer
+	enc := json.NewEncoder(&wrapper)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(map[string]interface{}{"tool_uses": uses}); err != nil {
+		return nil, false
+	}
+
+	tokens := overheadTokens(tokensForParallelWrapper)
+	tokens = append(tokens, c.encode("multi_tool_use.parallel")...)
+	return append(tokens, c.encode(strings.TrimSuffix(wrapper.String(), "\n"))...), true
+}
+
+// compactArguments returns arguments without whitespace between tokens, as
+// the model generates them inside the parallel wrapper.
+func compactArguments(arguments string) json.RawMessage {
+	var buf bytes.Buffer
+	if err := json.Compact(&buf, []byte(arguments)); err != nil {
+		return json.RawMessage(arguments)
+	}
+	return buf.Bytes()
+}
+
+// wrappedArguments reports whether tool call arguments were unpacked from
+// the multi_tool_use.parallel wrapper, which happens even for a single call.
+// OpenAI re-serialises unpacked arguments with Python's default separators,
+// ", " and ": ", while arguments of a direct call are returned as the model
+// generated them, which is compact JSON. This is a heuristic, inferred from
+// only two cases of TestCountResponseTokens: "Single complete message with
+// tool call" has compact arguments and costs 40 tokens, while the "variant"
+// with the same call spaced out costs 62, the same as a wrapped call.
+func wrappedArguments(arguments string) bool {
+	var (
+		inString, escaped bool
+		separators        int
+	)
+	for i := 0; i < len(arguments); i++ {
+		ch := arguments[i]
+		switch {
+		case inString:
+			switch {
+			case escaped:
+				escaped = false
+			case ch == '\\':
+				escaped = true
+			case ch == '"':
+				inString = false
+			}
+		case ch == '"':
+			inString = true
+		case ch == ',' || ch == ':':
+			if i+2 >= len(arguments) || arguments[i+1] != ' ' || arguments[i+2] == ' ' {
+				return false
+			}
+			separators++
+			i++
+		case ch == ' ' || ch == '\n' || ch == '\t' || ch == '\r':
+			return false
+		}
+	}
+	return separators > 0
+}
@@ -0,0 +1,108 @@
+package tokens
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+func TestCountChoiceTokens(t *testing.T) {
+	c := newTestCounter(t, openai.GPT4o)
+
+	resp := `{
+		"choices": [
+			{"index": 0, "message": {"role": "assistant", "content": "Hi"}, "finish_reason": "stop"},
+			{"index": 1, "message": {"role": "assistant", "content": null, "refusal": "No."}, "finish_reason": "stop"},
+			{"index": 2, "message": {"role": "assistant", "content": "Once upon a"}, "finish_reason": "length"},
+			{"index": 3, "message": {"role": "assistant", "tool_calls": [
+				{"id": "call_1", "type": "function", "function": {"name": "f", "arguments": "{\"a\":1}"}}
+			]}, "finish_reason": "tool_calls"},
+			{"index": 4, "message": {"role": "assistant", "tool_calls": [
+				{"id": "call_2", "type": "function", "function": {"name": "f", "arguments": "{\"a\": 1}"}},
+				{"id": "call_3", "type": "function", "function": {"name": "g", "arguments": "{}"}}
+			]}, "finish_reason": "tool_calls"}
+		]
+	}`
+	req := openai.ChatCompletionRequest{N: 5, MaxTokens: 8}
+
+	got, err := c.CountChoiceTokens(req, []byte(resp))
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrapper := `{"tool_uses":[{"recipient_name":"functions.f","parameters":{"a":1}},{"recipient_name":"functions.g","parameters":{}}]}`
+	want := []ChoiceTokens{
+		{Index: 0, FinishReason: "stop", Tokens: len("Hi")},
+		{Index: 1, FinishReason: "stop", Tokens: len("No.")},
+		{Index: 2, FinishReason: "length", Tokens: 8, Exact: true},
+		{Index: 3, FinishReason: "tool_calls", Tokens: tokensPerCompletionToolCall + len("functions.f") + len(`{"a":1}`)},
+		{Index: 4, FinishReason: "tool_calls", Tokens: 8 + len("multi_tool_use.parallel") + len(wrapper)},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	total, err := c.CountCompletionTokens(req, []byte(resp))
+	var wantTotal int
+	for _, choice := range want {
+		wantTotal += choice.Tokens
+	}
+	if err != nil || total != wantTotal {
+		t.Errorf("CountCompletionTokens: got %d, %v, want %d", total, err, wantTotal)
+	}
+
+	if got := MaxChatCompletionTokens(req); got != 40 {
+		t.Errorf("MaxChatCompletionTokens: got %d, want 40", got)
+	}
+}
+
+func TestCountChoiceTokensOpenAI(t *testing.T) {
+	c := newTestCounter(t, openai.GPT4o)
+
+	// Setting both Content and MultiContent makes the response fail to
+	// marshal, so it must be counted from the struct.
+	resp := openai.ChatCompletionResponse{
+		Choices: []openai.ChatCompletionChoice{{
+			Message: openai.ChatCompletionMessage{
+				Role:    openai.ChatMessageRoleAssistant,
+				Content: "ignored",
+				MultiContent: []openai.ChatMessagePart{
+					{Type: openai.ChatMessagePartTypeText, Text: "Sunny."},
+				},
+			},
+			FinishReason: openai.FinishReasonStop,
+		}},
+	}
+	if _, err := resp.Choices[0].Message.MarshalJSON(); err == nil {
+		t.Fatal("message with Content and MultiContent marshalled")
+	}
+
+	for _, r := range []any{resp, &resp} {
+		got, err := c.CountCompletionTokens(openai.ChatCompletionRequest{}, r)
+		if err != nil || got != len("Sunny.") {
+			t.Errorf("CountCompletionTokens(%T): got %d, %v, want %d", r, got, err, len("Sunny."))
+		}
+	}
+	if got := c.CountResponseTokens(resp); got != len("Sunny.") {
+		t.Errorf("CountResponseTokens: got %d, want %d", got, len("Sunny."))
+	}
+}
+
+func TestWrappedArguments(t *testing.T) {
+	tests := []struct {
+		arguments string
+		want      bool
+	}{
+		{`{"location":"Killington, VT"}`, false},
+		{`{"location": "Killington, VT"}`, true},
+		{`{"location": "Vail, CO", "unit": "fahrenheit"}`, true},
+		{`{"location": "Vail, CO","unit": "fahrenheit"}`, false},
+		{"{\n  \"location\": \"Vail, CO\"\n}", false},
+		{`{}`, false},
+	}
+	for _, tt := range tests {
+		if got := wrappedArguments(tt.arguments); got != tt.want {
+			t.Errorf("wrappedArguments(%s): got %v, want %v", tt.arguments, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+// Command tokens counts and prices OpenAI request files.
+//
+// Usage:
+//
+//	tokens batch [-json] file.jsonl
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"text/tabwriter"
+
+	"github.com/chrisdinn/tokens"
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, `usage: tokens <command> [flags] [file]
+
+commands:
+  batch    count tokens and estimate the cost of a Batch API input file
+`)
+	os.Exit(2)
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+
+	var err error
+	switch os.Args[1] {
+	case "batch":
+		err = runBatch(os.Args[2:])
+	default:
+		usage()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "tokens %s: %v\n", os.Args[1], err)
+		os.Exit(1)
+	}
+}
+
+func runBatch(args []string) error {
+	fs := flag.NewFlagSet("batch", flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "print the report as JSON")
+	fs.Parse(args)
+
+	in, err := openInput(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	report, err := tokens.AnalyzeBatch(in, tokens.BatchOptions{})
+	if err != nil {
+		return err
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(report)
+	}
+
+	fmt.Printf("%d requests, %d bytes\n\n", report.Lines, report.Bytes)
+
+	models := make([]string, 0, len(report.Models))
+	for model := range report.Models {
+		models = append(models, model)
+	}
+	sort.Strings(models)
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "MODEL\tREQUESTS\tPROMPT\tMAX COMPLETION\tUNBOUNDED\tCOST")
+	for _, model := range models {
+		total := report.Models[model]
+		cost := "unknown"
+		if total.Priced {
+			cost = fmt.Sprintf("$%.4f", total.Cost)
+		}
+		fmt.Fprintf(
+			tw,
+			"%s\t%d\t%d\t%d\t%d\t%s\n",
+			model,
+			total.Requests,
+			total.PromptTokens,
+			total.MaxCompletionTokens,
+			total.Unbounded,
+			cost,
+		)
+	}
+	tw.Flush()
+	fmt.Printf("\nEstimated batch cost: $%.4f\n", report.Cost)
+
+	if len(report.Issues) > 0 {
+		fmt.Printf("\n%d issues:\n", len(report.Issues))
+		for _, issue := range report.Issues {
+			switch {
+			case issue.Line == 0:
+				fmt.Printf("  file: %s\n", issue.Problem)
+			case issue.CustomID != "":
+				fmt.Printf("  line %d (%s): %s\n", issue.Line, issue.CustomID, issue.Problem)
+			default:
+				fmt.Printf("  line %d: %s\n", issue.Line, issue.Problem)
+			}
+		}
+	}
+
+	return nil
+}
+
+// openInput opens path, or stdin if path is empty or "-".
+func openInput(path string) (io.ReadCloser, error) {
+	if path == "" || path == "-" {
+		return io.NopCloser(os.Stdin), nil
+	}
+	return os.Open(path)
+}
@@ -0,0 +1,191 @@
+package tokens
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+// defaultCompletionMaxTokens is the max_tokens the legacy completions API uses
+// when none is given.
+const defaultCompletionMaxTokens = 16
+
+// completionPrompt is a single prompt of a legacy completions request, either
+// as text or as token IDs.
+type completionPrompt struct {
+	text   string
+	tokens []int
+}
+
+// completionPrompts splits a legacy completions prompt, which may be a
+// string, an array of strings, an array of token IDs or an array of token ID
+// arrays, into its individual prompts.
+func completionPrompts(prompt any) ([]completionPrompt, error) {
+	switch p := prompt.(type) {
+	case nil:
+		// The API defaults to the <|endoftext|> document separator.
+		return []completionPrompt{{text: "<|endoftext|>"}}, nil
+	case string:
+		return []completionPrompt{{text: p}}, nil
+	case []string:
+		prompts := make([]completionPrompt, len(p))
+		for i, s := range p {
+			prompts[i] = completionPrompt{text: s}
+		}
+		return prompts, nil
+	case []int:
+		return []completionPrompt{{tokens: p}}, nil
+	case [][]int:
+		prompts := make([]completionPrompt, len(p))
+		for i, ids := range p {
+			prompts[i] = completionPrompt{tokens: ids}
+		}
+		return prompts, nil
+	case []any:
+		if len(p) == 0 {
+			return nil, fmt.Errorf("empty prompt")
+		}
+		if _, ok := p[0].(float64); ok {
+			ids, err := tokenIDs(p)
+			if err != nil {
+				return nil, err
+			}
+			return []completionPrompt{{tokens: ids}}, nil
+		}
+		prompts := make([]completionPrompt, len(p))
+		for i, el := range p {
+			switch el := el.(type) {
+			case string:
+				prompts[i] = completionPrompt{text: el}
+			case []any:
+				ids, err := tokenIDs(el)
+				if err != nil {
+					return nil, err
+				}
+				prompts[i] = completionPrompt{tokens: ids}
+			default:
+				return nil, fmt.Errorf("unsupported prompt element %T", el)
+			}
+		}
+		return prompts, nil
+	default:
+		return nil, fmt.Errorf("unsupported prompt %T", prompt)
+	}
+}
+
+// tokenIDs converts token IDs decoded from JSON into ints.
+func tokenIDs(in []any) ([]int, error) {
+	ids := make([]int, len(in))
+	for i, el := range in {
+		f, ok := el.(float64)
+		if !ok {
+			return nil, fmt.Errorf("unsupported token ID %T", el)
+		}
+		ids[i] = int(f)
+	}
+	return ids, nil
+}
+
+func (c *Counter) countCompletionPrompt(p completionPrompt) int {
+	if p.tokens != nil {
+		return len(p.tokens)
+	}
+	// The legacy API treats special tokens in prompts as text, except for the
+	// document separator.
+	if t, ok := c.tokenizer.(specialEncoder); ok {
+		return len(t.EncodeSpecial(p.text, []string{"<|endoftext|>"}))
+	}
+	return c.tokenizer.Count(p.text)
+}
+
+// CountCompletionRequestTokens returns the prompt tokens billed for a legacy
+// completions request. Each prompt in an array is billed once, along with
+// the suffix, regardless of N and BestOf.
+func (c *Counter) CountCompletionRequestTokens(
+	req openai.CompletionRequest,
+) (int, error) {
+	prompts, err := completionPrompts(req.Prompt)
+	if err != nil {
+		return 0, err
+	}
+
+	var count int
+	for _, p := range prompts {
+		count += c.countCompletionPrompt(p)
+		if req.Suffix != "" {
+			count += c.CountTokens(req.Suffix)
+		}
+	}
+
+	return count, nil
+}
+
+// MaxCompletionRequestTokens returns the most completion tokens a legacy
+// completions request can be billed for. Every prompt generates BestOf
+// completions, or N if that's larger, of up to MaxTokens each.
+func MaxCompletionRequestTokens(req openai.CompletionRequest) (int, error) {
+	prompts, err := completionPrompts(req.Prompt)
+	if err != nil {
+		return 0, err
+	}
+
+	maxTokens := req.MaxTokens
+	if maxTokens == 0 {
+		maxTokens = defaultCompletionMaxTokens
+	}
+
+	return len(prompts) * completionsPerPrompt(req) * maxTokens, nil
+}
+
+func completionsPerPrompt(req openai.CompletionRequest) int {
+	n := req.N
+	if n < 1 {
+		n = 1
+	}
+	if req.BestOf > n {
+		return req.BestOf
+	}
+	return n
+}
+
+// CountCompletionResponseTokens returns the number of completion tokens in
+// the choices of a legacy completions response. With Echo set, each choice
+// begins with its prompt, which isn't counted. When BestOf is larger than N
+// the candidates that weren't returned are billed too, and can't be counted
+// from the response.
+func (c *Counter) CountCompletionResponseTokens(
+	req openai.CompletionRequest,
+	resp openai.CompletionResponse,
+) (int, error) {
+	var prompts []completionPrompt
+	if req.Echo {
+		var err error
+		if prompts, err = completionPrompts(req.Prompt); err != nil {
+			return 0, err
+		}
+	}
+
+	n := req.N
+	if n < 1 {
+		n = 1
+	}
+
+	var count int
+	for _, choice := range resp.Choices {
+		text := choice.Text
+		if req.Echo {
+			// Choices are ordered by prompt, with N choices per prompt.
+			if i := choice.Index / n; i < len(prompts) {
+				prompt := prompts[i].text
+				if prompts[i].tokens != nil {
+					prompt = c.tokenizer.Decode(prompts[i].tokens)
+				}
+				text = strings.TrimPrefix(text, prompt)
+			}
+		}
+		count += c.CountTokens(text)
+	}
+
+	return count, nil
+}
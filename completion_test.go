@@ -0,0 +1,167 @@
+package tokens
+
+import (
+	"testing"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+func TestCompletionRequestPreTokenized(t *testing.T) {
+	tests := []struct {
+		name           string
+		in             openai.CompletionRequest
+		wantPrompt     int
+		wantCompletion int
+	}{{
+		name: "Token IDs",
+		in: openai.CompletionRequest{
+			Prompt:    []int{1, 2, 3},
+			MaxTokens: 10,
+		},
+		wantPrompt:     3,
+		wantCompletion: 10,
+	}, {
+		name: "Token ID arrays with N",
+		in: openai.CompletionRequest{
+			Prompt:    [][]int{{1, 2}, {3, 4, 5}},
+			MaxTokens: 10,
+			N:         2,
+		},
+		wantPrompt:     5,
+		wantCompletion: 40,
+	}, {
+		name: "Token ID arrays decoded from JSON with BestOf",
+		in: openai.CompletionRequest{
+			Prompt: []any{[]any{1.0, 2.0}, []any{3.0}},
+			N:      1,
+			BestOf: 3,
+		},
+		wantPrompt:     3,
+		wantCompletion: 2 * 3 * defaultCompletionMaxTokens,
+	}}
+
+	// Pre-tokenized prompts don't need a tokenizer.
+	c := &Counter{model: openai.GPT3Dot5TurboInstruct}
+	for _, tt := range tests {
+		gotPrompt, err := c.CountCompletionRequestTokens(tt.in)
+		if err != nil {
+			t.Errorf("%s: CountCompletionRequestTokens: %v", tt.name, err)
+			continue
+		}
+		if gotPrompt != tt.wantPrompt {
+			t.Errorf("%s: prompt tokens got %d, want %d", tt.name, gotPrompt, tt.wantPrompt)
+		}
+
+		gotCompletion, err := MaxCompletionRequestTokens(tt.in)
+		if err != nil {
+			t.Errorf("%s: MaxCompletionRequestTokens: %v", tt.name, err)
+			continue
+		}
+		if gotCompletion != tt.wantCompletion {
+			t.Errorf("%s: max completion tokens got %d, want %d", tt.name, gotCompletion, tt.wantCompletion)
+		}
+	}
+}
+
+func TestCompletionRequestText(t *testing.T) {
+	tests := []struct {
+		name           string
+		in             openai.CompletionRequest
+		wantPrompt     int
+		wantCompletion int
+	}{{
+		name:           "String",
+		in:             openai.CompletionRequest{Prompt: "Say hi", MaxTokens: 10},
+		wantPrompt:     len("Say hi"),
+		wantCompletion: 10,
+	}, {
+		name: "Strings with suffix",
+		in: openai.CompletionRequest{
+			Prompt:    []string{"ab", "cde"},
+			Suffix:    "xy",
+			MaxTokens: 5,
+			N:         2,
+		},
+		// The suffix is billed with every prompt.
+		wantPrompt:     len("ab") + len("xy") + len("cde") + len("xy"),
+		wantCompletion: 2 * 2 * 5,
+	}, {
+		name: "Strings decoded from JSON",
+		in: openai.CompletionRequest{
+			Prompt: []any{"ab", "cde"},
+			N:      3,
+			BestOf: 2,
+		},
+		wantPrompt:     len("ab") + len("cde"),
+		wantCompletion: 2 * 3 * defaultCompletionMaxTokens,
+	}, {
+		name:           "No prompt",
+		in:             openai.CompletionRequest{MaxTokens: 1},
+		wantPrompt:     len("<|endoftext|>"),
+		wantCompletion: 1,
+	}}
+
+	c := newTestCounter(t, openai.GPT3Dot5TurboInstruct)
+	for _, tt := range tests {
+		gotPrompt, err := c.CountCompletionRequestTokens(tt.in)
+		if err != nil {
+			t.Errorf("%s: CountCompletionRequestTokens: %v", tt.name, err)
+			continue
+		}
+		if gotPrompt != tt.wantPrompt {
+			t.Errorf("%s: prompt tokens got %d, want %d", tt.name, gotPrompt, tt.wantPrompt)
+		}
+
+		gotCompletion, err := MaxCompletionRequestTokens(tt.in)
+		if err != nil {
+			t.Errorf("%s: MaxCompletionRequestTokens: %v", tt.name, err)
+			continue
+		}
+		if gotCompletion != tt.wantCompletion {
+			t.Errorf("%s: max completion tokens got %d, want %d", tt.name, gotCompletion, tt.wantCompletion)
+		}
+	}
+
+	if _, err := c.CountCompletionRequestTokens(openai.CompletionRequest{Prompt: 1}); err == nil {
+		t.Error("numeric prompt: got nil error")
+	}
+}
+
+func TestCountCompletionResponseTokens(t *testing.T) {
+	c := newTestCounter(t, openai.GPT3Dot5TurboInstruct)
+
+	resp := openai.CompletionResponse{Choices: []openai.CompletionChoice{
+		{Index: 0, Text: "Hi there"},
+		{Index: 1, Text: "Hi!"},
+		{Index: 2, Text: "Yo dude"},
+		{Index: 3, Text: "Yo"},
+	}}
+	tests := []struct {
+		name string
+		req  openai.CompletionRequest
+		want int
+	}{{
+		name: "Without echo",
+		req:  openai.CompletionRequest{Prompt: []string{"Hi", "Yo"}, N: 2},
+		want: len("Hi there") + len("Hi!") + len("Yo dude") + len("Yo"),
+	}, {
+		// Choices are grouped by prompt, N at a time, and begin with it.
+		name: "Echo",
+		req:  openai.CompletionRequest{Prompt: []string{"Hi", "Yo"}, N: 2, Echo: true},
+		want: len(" there") + len("!") + len(" dude"),
+	}, {
+		name: "Echo with token IDs",
+		req:  openai.CompletionRequest{Prompt: [][]int{{'H', 'i'}, {'Y', 'o'}}, N: 2, Echo: true},
+		want: len(" there") + len("!") + len(" dude"),
+	}}
+	for _, tt := range tests {
+		got, err := c.CountCompletionResponseTokens(tt.req, resp)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s: got %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
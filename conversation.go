@@ -0,0 +1,161 @@
+package tokens
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+// Conversation holds the messages of a chat and their token counts, updating
+// the counts incrementally as messages change so that long histories aren't
+// re-encoded on every turn. Its total always matches CountRequestTokens for
+// the equivalent request. A Conversation is not safe for concurrent use.
+type Conversation struct {
+	counter    *Counter
+	messages   []openai.ChatCompletionMessage
+	counts     []int
+	toolChoice any
+
+	tools      []openai.Tool
+	toolsHash  [sha256.Size]byte
+	toolsBlock string
+	// toolsCount is the count of the system message the tool definitions
+	// are rendered into, or of the system message they're rendered as if
+	// there isn't one. toolsIndex is the message it belongs to, -1 for the
+	// latter, and -2 when it needs recounting.
+	toolsCount int
+	toolsIndex int
+}
+
+// NewConversation creates an empty conversation counted by c.
+func (c *Counter) NewConversation() *Conversation {
+	return &Conversation{
+		counter:    c,
+		toolsIndex: -2,
+	}
+}
+
+// SetTools sets the tools available in the conversation. The tool
+// definitions are only re-rendered when they change.
+func (cv *Conversation) SetTools(tools []openai.Tool) {
+	hash := hashTools(tools)
+	if hash == cv.toolsHash && len(tools) == len(cv.tools) {
+		return
+	}
+
+	cv.tools = tools
+	cv.toolsHash = hash
+	cv.toolsBlock = ""
+	if len(tools) > 0 {
+		cv.toolsBlock = formatFunctionDefinitions(toolDefsFromOpenAI(tools))
+	}
+	cv.toolsIndex = -2
+}
+
+func hashTools(tools []openai.Tool) [sha256.Size]byte {
+	b, _ := json.Marshal(tools)
+	return sha256.Sum256(b)
+}
+
+// SetToolChoice sets the request's tool choice.
+func (cv *Conversation) SetToolChoice(toolChoice any) {
+	cv.toolChoice = toolChoice
+}
+
+// Append adds messages to the end of the conversation, counting only the new
+// messages.
+func (cv *Conversation) Append(messages ...openai.ChatCompletionMessage) {
+	for _, m := range messages {
+		cv.messages = append(cv.messages, m)
+		cv.counts = append(cv.counts, cv.countMessage(m))
+		if m.Role == openai.ChatMessageRoleSystem && cv.toolsIndex == -1 {
+			// The tools now belong to this, the first, system message.
+			cv.toolsIndex = -2
+		}
+	}
+}
+
+// Replace replaces the message at index i. It panics if i is out of range.
+func (cv *Conversation) Replace(i int, m openai.ChatCompletionMessage) {
+	old := cv.messages[i]
+	cv.messages[i] = m
+	cv.counts[i] = cv.countMessage(m)
+	if i == cv.toolsIndex ||
+		old.Role == openai.ChatMessageRoleSystem || m.Role == openai.ChatMessageRoleSystem {
+		cv.toolsIndex = -2
+	}
+}
+
+// Truncate keeps the first n messages. It panics if n is out of range.
+func (cv *Conversation) Truncate(n int) {
+	cv.messages = cv.messages[:n]
+	cv.counts = cv.counts[:n]
+	if cv.toolsIndex >= n {
+		cv.toolsIndex = -2
+	}
+}
+
+// Messages returns the conversation's messages. The slice must not be
+// modified.
+func (cv *Conversation) Messages() []openai.ChatCompletionMessage {
+	return cv.messages
+}
+
+// Request returns a request holding the conversation's messages, tools and
+// tool choice.
+func (cv *Conversation) Request() openai.ChatCompletionRequest {
+	return openai.ChatCompletionRequest{
+		Messages:   append([]openai.ChatCompletionMessage(nil), cv.messages...),
+		Tools:      cv.tools,
+		ToolChoice: cv.toolChoice,
+	}
+}
+
+// CountTokens returns the number of tokens in the conversation as a request.
+func (cv *Conversation) CountTokens() int {
+	count := tokensForPriming
+
+	for _, n := range cv.counts {
+		count += n
+	}
+
+	if len(cv.tools) > 0 {
+		cv.countTools()
+		if cv.toolsIndex >= 0 {
+			// The system message is rendered with the tools instead.
+			count -= cv.counts[cv.toolsIndex]
+		}
+		count += cv.toolsCount
+	}
+
+	count += len(cv.counter.encodeToolChoice(toolChoiceFromOpenAI(cv.toolChoice)))
+
+	return count
+}
+
+func (cv *Conversation) countMessage(m openai.ChatCompletionMessage) int {
+	return tokensPerReqMessage + cv.counter.CountMessageTokens(m)
+}
+
+// countTools recounts the system message holding the tool definitions if it
+// has changed.
+func (cv *Conversation) countTools() {
+	if cv.toolsIndex != -2 {
+		return
+	}
+
+	cv.toolsIndex = -1
+	system := chatMessage{
+		role:  openai.ChatMessageRoleSystem,
+		parts: []contentPart{{kind: partText, text: cv.toolsBlock}},
+	}
+	for i, m := range cv.messages {
+		if m.Role == openai.ChatMessageRoleSystem {
+			cv.toolsIndex = i
+			system = withToolDefinitions(messageFromOpenAI(m), cv.toolsBlock)
+			break
+		}
+	}
+	cv.toolsCount = tokensPerReqMessage + len(cv.counter.encodeMessage(system))
+}
@@ -0,0 +1,62 @@
+package tokens
+
+import (
+	"testing"
+
+	"github.com/sashabaranov/go-openai"
+	"github.com/sashabaranov/go-openai/jsonschema"
+)
+
+func TestConversationMatchesRequest(t *testing.T) {
+	c := newTestCounter(t, openai.GPT4o)
+	tools := []openai.Tool{{
+		Type: openai.ToolTypeFunction,
+		Function: &openai.FunctionDefinition{
+			Name:        "get_current_weather",
+			Description: "Get the current weather in a given location.",
+			Parameters: jsonschema.Definition{
+				Type: jsonschema.Object,
+				Properties: map[string]jsonschema.Definition{
+					"location": {Type: jsonschema.String},
+				},
+			},
+		},
+	}}
+	user := openai.ChatCompletionMessage{Role: openai.ChatMessageRoleUser, Content: "Weather in Vail?"}
+	system := openai.ChatCompletionMessage{Role: openai.ChatMessageRoleSystem, Content: "Be brief."}
+	call := openai.ChatCompletionMessage{
+		Role: openai.ChatMessageRoleAssistant,
+		ToolCalls: []openai.ToolCall{{
+			ID:       "call_1",
+			Type:     openai.ToolTypeFunction,
+			Function: openai.FunctionCall{Name: "get_current_weather", Arguments: `{"location":"Vail, CO"}`},
+		}},
+	}
+	result := openai.ChatCompletionMessage{Role: openai.ChatMessageRoleTool, Content: "Sunny", ToolCallID: "call_1"}
+
+	conv := c.NewConversation()
+	check := func(step string) {
+		t.Helper()
+		if got, want := conv.CountTokens(), c.CountRequestTokens(conv.Request()); got != want {
+			t.Errorf("%s: got %d, want %d", step, got, want)
+		}
+	}
+
+	conv.Append(user)
+	check("user message")
+	conv.SetTools(tools)
+	check("tools without a system message")
+	conv.Append(call, result, result)
+	check("tool calls")
+	conv.Replace(0, system)
+	check("system message replacing the first")
+	conv.SetToolChoice(openai.ToolChoice{
+		Type:     openai.ToolTypeFunction,
+		Function: openai.ToolFunction{Name: "get_current_weather"},
+	})
+	check("tool choice")
+	conv.Truncate(1)
+	check("truncated to the system message")
+	conv.SetTools(nil)
+	check("tools removed")
+}
@@ -2,7 +2,10 @@ package tokens
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"sort"
 	"strings"
 
 	"github.com/pkoukk/tiktoken-go"
@@ -10,125 +13,202 @@ import (
 )
 
 type Counter struct {
-	model     string
-	tokenizer *tiktoken.Tiktoken
+	model          string
+	tokenizer      Tokenizer
+	toolCallFormat ToolCallFormat
 }
 
-// NewCounter creates a new token counter for the specified model.
-func NewCounter(model string) (*Counter, error) {
-	tokenizer, err := tiktoken.EncodingForModel(model)
-	if err != nil {
-		return nil, err
+// modelEncodings overrides tiktoken's model to encoding mapping for models it
+// doesn't know, or only matches by prefix.
+var modelEncodings = map[string]string{
+	"gpt-3.5-turbo-instruct": tiktoken.MODEL_CL100K_BASE,
+	"davinci-002":            tiktoken.MODEL_CL100K_BASE,
+	"babbage-002":            tiktoken.MODEL_CL100K_BASE,
+}
+
+// NewCounter creates a new token counter for the specified model. Unless a
+// tokenizer is given with WithTokenizer, the model's tiktoken encoding is
+// used.
+func NewCounter(model string, opts ...Option) (*Counter, error) {
+	c := &Counter{
+		model:          model,
+		toolCallFormat: toolCallFormatFor(model),
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	if c.tokenizer == nil {
+		tokenizer, err := tiktokenForModel(model)
+		if err != nil {
+			return nil, err
+		}
+		c.tokenizer = tokenizer
 	}
-	return &Counter{
-		model:     model,
-		tokenizer: tokenizer,
-	}, nil
+
+	return c, nil
 }
 
 // CountTokens returns the number of tokens in a string.
 func (c *Counter) CountTokens(txt string) int {
-	tokens := c.tokenizer.Encode(txt, nil, nil)
-	return len(tokens)
+	return c.tokenizer.Count(txt)
 }
 
 var (
 	tokensPerReqMessage = 3
 	tokensPerName       = 1
-	tokensForMultiTool  = 13
+	tokensForPriming    = 3
+	// Tool choices other than a named function don't render any text, but
+	// "none" costs a token. "auto" is the default, and "required" is
+	// enforced while sampling rather than in the prompt, so neither adds
+	// anything. Tool definitions are rendered in every case. These are
+	// estimates with no recorded usage behind them yet;
+	// TestToolChoiceOverhead derives them from the API's prompt_tokens for
+	// the same request under each choice.
+	tokensForToolChoiceNone     = 1
+	tokensForToolChoiceRequired = 0
 )
 
+// tokenOverhead stands in for the tokens OpenAI's prompt format adds around
+// messages, which don't come from encoding any text we can see.
+const tokenOverhead = -1
+
+func overheadTokens(n int) []int {
+	tokens := make([]int, n)
+	for i := range tokens {
+		tokens[i] = tokenOverhead
+	}
+	return tokens
+}
+
+func (c *Counter) encode(txt string) []int {
+	return c.tokenizer.Encode(txt)
+}
+
 // CountRequestTokens returns the number of tokens in a chat completion request.
 func (c *Counter) CountRequestTokens(
 	req openai.ChatCompletionRequest,
 ) int {
-	var (
-		count int
-	)
+	return len(c.render(fromOpenAI(req)).tokens)
+}
 
-	// Every reply is primed with `<|start|>assistant<|message|>` and this each
-	// completion (vs message) carries an overhead of 3 tokens.
-	count += 3
+// renderedRequest is a request rendered as the sequence of tokens the model
+// sees, in order. Overhead tokens are tokenOverhead and audio tokens are
+// tokenAudio.
+type renderedRequest struct {
+	tokens []int
+	// messages are the request's messages after tool definitions are
+	// inserted, and starts holds the offset of each in tokens.
+	messages []chatMessage
+	starts   []int
+	// end is the offset in tokens just past the last message.
+	end int
+	// injectedSystem is true when tool definitions were rendered as a new
+	// system message ahead of the request's own messages.
+	injectedSystem bool
+	// media holds the placeholder tokens of image and audio parts, which
+	// are the same whatever the part's content.
+	media []mediaSpan
+}
+
+// mediaSpan is the tokens[start:end] of an image or audio part, with a hash
+// of its URL or data.
+type mediaSpan struct {
+	start, end int
+	hash       uint32
+}
+
+func (c *Counter) render(req chatRequest) renderedRequest {
+	var r renderedRequest
+
+	r.messages = append([]chatMessage(nil), req.messages...)
 
-	if len(req.Tools) > 0 {
-		// Insert tools into a system prompt. Choose the first system prompt,
-		// or if there are none, create one and prepend it.
+	var blocks []string
+	if len(req.tools) > 0 {
+		blocks = append(blocks, formatFunctionDefinitions(req.tools))
+	}
+	if req.responseFormat != nil {
+		blocks = append(blocks, formatResponseFormat(*req.responseFormat))
+	}
+	if len(blocks) > 0 {
+		// Insert tools and response formats into a system prompt. Choose the
+		// first system prompt, or if there are none, create one and prepend
+		// it.
+		definitions := strings.Join(blocks, "\n\n")
 		var addedTools bool
-		for i, message := range req.Messages {
-			if message.Role == openai.ChatMessageRoleSystem {
-				req.Messages[i].Content = fmt.Sprintf(
-					"%s\n\n%s",
-					message.Content,
-					formatFunctionDefinitions(req.Tools),
-				)
+		for i, message := range r.messages {
+			if message.role == openai.ChatMessageRoleSystem {
+				r.messages[i] = withToolDefinitions(message, definitions)
 				addedTools = true
 				break
 			}
 		}
 		if !addedTools {
-			req.Messages = append(
-				[]openai.ChatCompletionMessage{{
-					Role:    openai.ChatMessageRoleSystem,
-					Content: formatFunctionDefinitions(req.Tools),
+			r.messages = append(
+				[]chatMessage{{
+					role:  openai.ChatMessageRoleSystem,
+					parts: []contentPart{{kind: partText, text: definitions}},
 				}},
-				req.Messages...,
+				r.messages...,
 			)
+			r.injectedSystem = true
 		}
 	}
 
-	for _, message := range req.Messages {
-		count += tokensPerReqMessage
-		got := c.CountMessageTokens(message)
-		count += got
+	for _, message := range r.messages {
+		r.starts = append(r.starts, len(r.tokens))
+		r.tokens = append(r.tokens, overheadTokens(tokensPerReqMessage)...)
+		c.renderMessage(&r, message)
 	}
+	r.end = len(r.tokens)
 
-	// Requests with 2 or more tool messages have a different token count. The
-	// reason for this is not yet understood.
-	var toolMessages int
-	for _, message := range req.Messages {
-		if message.Role == openai.ChatMessageRoleTool {
-			toolMessages++
-		}
-	}
-	if toolMessages > 1 {
-		count += tokensForMultiTool
-	}
+	r.tokens = append(r.tokens, c.encodeToolChoice(req.toolChoice)...)
 
-	if req.ToolChoice != nil {
-		count += c.countToolChoice(req.ToolChoice)
-	}
+	// Every reply is primed with `<|start|>assistant<|message|>` and this each
+	// completion (vs message) carries an overhead of 3 tokens.
+	r.tokens = append(r.tokens, overheadTokens(tokensForPriming)...)
+
+	return r
+}
 
-	return count
+// withToolDefinitions returns a system message with the rendered tool
+// definitions appended to its text.
+func withToolDefinitions(message chatMessage, definitions string) chatMessage {
+	message.parts = []contentPart{{
+		kind: partText,
+		text: fmt.Sprintf("%s\n\n%s", message.text(), definitions),
+	}}
+	return message
 }
 
-func (c *Counter) countToolChoice(toolChoice any) int {
-	switch t := toolChoice.(type) {
-	case openai.ToolChoice:
+func (c *Counter) encodeToolChoice(toolChoice toolChoice) []int {
+	switch toolChoice.mode {
+	case toolChoiceNone:
+		return overheadTokens(tokensForToolChoiceNone)
+	case toolChoiceRequired:
+		return overheadTokens(tokensForToolChoiceRequired)
+	case toolChoiceFunction:
 		tcString := `{
- "name": "` + t.Function.Name + `"
+ "name": "` + toolChoice.name + `"
 }`
-		return c.CountTokens(tcString)
+		return c.encode(tcString)
 	default:
-		return 0
+		return nil
 	}
 }
 
-// CountResponseTokens returns the number of tokens in a chat completion response.
+// CountResponseTokens returns the number of completion tokens in a chat
+// completion response, summed over its choices. Use CountCompletionTokens to
+// count choices cut off by max_tokens exactly.
+//
+// Tool calls are estimates. The tokens around each call, and whether a single
+// call was made through the multi_tool_use.parallel wrapper, which is guessed
+// from the whitespace in its arguments, are fitted to only a few recorded
+// responses.
 func (c *Counter) CountResponseTokens(
 	resp openai.ChatCompletionResponse,
 ) int {
-	var (
-		count int
-	)
-
-	for _, choice := range resp.Choices {
-		count += c.CountMessageTokens(choice.Message)
-
-		// Don't count the role.
-		count -= c.CountTokens(choice.Message.Role)
-	}
-
-	return count
+	return sumChoiceTokens(c.countChoices(openai.ChatCompletionRequest{}, choicesFromOpenAI(resp)))
 }
 
 // CountMessageTokens returns the number of tokens in a single message,
@@ -137,53 +217,103 @@ func (c *Counter) CountResponseTokens(
 func (c *Counter) CountMessageTokens(
 	message openai.ChatCompletionMessage,
 ) int {
-	var (
-		count int
-	)
-
-	count += c.CountTokens(message.Role)
+	return len(c.encodeMessage(messageFromOpenAI(message)))
+}
 
-	if message.Role == openai.ChatMessageRoleTool {
-		// Tool content, if it's JSON, is needs to be reformatted into the same
-		// JSON style as tool call arguments.
-		var contentJSON map[string]interface{}
-		if err := json.Unmarshal([]byte(message.Content), &contentJSON); err != nil {
-			count += c.CountTokens(fmt.Sprintf("%q: %q", "text", message.Content))
-		} else {
-			stringified, _ := stringifyObject(contentJSON, true)
+func (c *Counter) encodeMessage(
+	message chatMessage,
+) []int {
+	var r renderedRequest
+	c.renderMessage(&r, message)
+	return r.tokens
+}
 
-			count += c.CountTokens(stringified)
-		}
+// renderMessage appends a message's tokens, and the spans of its image and
+// audio parts, to r.
+func (c *Counter) renderMessage(r *renderedRequest, message chatMessage) {
+	tokens := append(r.tokens, c.encode(message.role)...)
 
+	if message.role == openai.ChatMessageRoleTool {
+		// Tool content, text parts included, is joined and re-serialised.
+		tokens = append(tokens, c.encode(formatToolContent(message.text()))...)
 	} else {
-		count += c.CountTokens(message.Content)
+		for _, part := range message.parts {
+			start := len(tokens)
+			switch part.kind {
+			case partImage:
+				tokens = append(tokens, overheadTokens(c.imageTokens(part.imageURL, part.imageDetail))...)
+				r.media = append(r.media, mediaSpan{start, len(tokens), contentHash(part.imageURL)})
+			case partAudio:
+				n, _ := inputAudioTokens(part.audioData, part.audioFormat)
+				tokens = append(tokens, audioTokens(n)...)
+				r.media = append(r.media, mediaSpan{start, len(tokens), contentHash(part.audioFormat, part.audioData)})
+			default:
+				tokens = append(tokens, c.encode(part.text)...)
+			}
+		}
 	}
 
-	for _, tc := range message.ToolCalls {
-		count += c.CountTokens(fmt.Sprintf(
-			"\"name\":%q, \"arguments\":%q",
-			tc.Function.Name,
-			tc.Function.Arguments,
-		))
+	// More than one tool call is rendered as the multi_tool_use.parallel
+	// call the model made them through, as in a completion.
+	wrapped := false
+	if len(message.toolCalls) > 1 {
+		var wrapper []int
+		if wrapper, wrapped = c.encodeParallelWrapper(message.toolCalls); wrapped {
+			tokens = append(tokens, wrapper...)
+		}
+	}
+	if !wrapped {
+		for _, tc := range message.toolCalls {
+			tokens = append(tokens, c.encodeToolCall(tc)...)
+		}
 	}
 
-	if message.Name != "" {
-		count += c.CountTokens(message.Name) + tokensPerName
+	if message.name != "" {
+		tokens = append(tokens, c.encode(message.name)...)
+		tokens = append(tokens, overheadTokens(tokensPerName)...)
 	}
 
-	return count
+	r.tokens = tokens
+}
+
+// formatToolContent formats tool message content the way OpenAI re-serialises
+// it. Content that's JSON, of any type, is reformatted into the same JSON
+// style as tool call arguments. Anything else, including JSON strings, is
+// rendered as a text field.
+func formatToolContent(content string) string {
+	var contentJSON interface{}
+	if err := unmarshalNumbers(content, &contentJSON); err == nil {
+		if _, isString := contentJSON.(string); !isString {
+			if formatted, err := formatValue(contentJSON, true); err == nil {
+				return formatted
+			}
+		}
+	}
+	return fmt.Sprintf("%q: %q", "text", content)
 }
 
 // CountToolTokens returns an estimated number of tokens in the provied set of
 // tools. Tools are included in requests differently depending on the contents
 // of the request, so this is an estimate.
 func (c *Counter) CountToolTokens(tools []openai.Tool) int {
-	txt := formatFunctionDefinitions(tools)
-	tokens := c.tokenizer.Encode(txt, nil, nil)
-	return len(tokens) + 3
+	txt := formatFunctionDefinitions(toolDefsFromOpenAI(tools))
+	return c.tokenizer.Count(txt) + 3
+}
+
+// formatResponseFormat renders a JSON schema response format the way it's
+// included in the system prompt, after any tools.
+func formatResponseFormat(f responseFormat) string {
+	lines := []string{"# Response Formats", "", "## " + f.name, ""}
+	if f.description != "" {
+		lines = append(lines, f.description, "")
+	}
+	schema, _ := json.Marshal(f.schema)
+	lines = append(lines, string(schema))
+
+	return strings.Join(lines, "\n")
 }
 
-func formatFunctionDefinitions(tools []openai.Tool) string {
+func formatFunctionDefinitions(tools []toolDef) string {
 	var lines []string
 	lines = append(
 		lines,
@@ -193,22 +323,17 @@ func formatFunctionDefinitions(tools []openai.Tool) string {
 	)
 
 	for _, tool := range tools {
-		function := tool.Function
-		if function.Description != "" {
-			lines = append(lines, fmt.Sprintf("// %s", function.Description))
+		if tool.description != "" {
+			lines = append(lines, fmt.Sprintf("// %s", tool.description))
 		}
 
-		paramsJSON, _ := json.Marshal(function.Parameters)
-		var params map[string]interface{}
-		json.Unmarshal(paramsJSON, &params)
-
-		properties, ok := params["properties"].(map[string]interface{})
+		properties, ok := tool.parameters["properties"].(map[string]interface{})
 		if ok && len(properties) > 0 {
-			lines = append(lines, fmt.Sprintf("type %s = (_: {", function.Name))
-			lines = append(lines, formatObjectProperties(params, 0))
+			lines = append(lines, fmt.Sprintf("type %s = (_: {", tool.name))
+			lines = append(lines, formatObjectProperties(tool.parameters, 0))
 			lines = append(lines, "}) => any;")
 		} else {
-			lines = append(lines, fmt.Sprintf("type %s = () => any;", function.Name))
+			lines = append(lines, fmt.Sprintf("type %s = () => any;", tool.name))
 		}
 	}
 
@@ -236,13 +361,18 @@ func formatObjectProperties(p map[string]interface{}, indent int) string {
 		}
 	}
 
+	// Render properties in a stable order, the same order go-openai marshals
+	// them in, so repeated renders of a request produce the same tokens.
 	var lines []string
-	for key, prop := range properties {
+	for _, key := range sortedKeys(properties) {
+		prop := properties[key]
 		props, ok := prop.(map[string]interface{})
 		if !ok {
 			continue // Skip if the property is not a JSON object
 		}
 
+		// Descriptions are rendered at every depth, indented with their
+		// property.
 		description, _ := props["description"].(string)
 		if description != "" {
 			lines = append(lines, fmt.Sprintf("// %s", description))
@@ -289,8 +419,8 @@ func formatType(props map[string]interface{}, indent int) string {
 		return "any[]"
 
 	case "object":
-		if properties, ok := props["properties"].(map[string]interface{}); ok {
-			return fmt.Sprintf("{\n%s\n}", formatObjectProperties(properties, indent+2))
+		if _, ok := props["properties"].(map[string]interface{}); ok {
+			return fmt.Sprintf("{\n%s\n}", formatObjectProperties(props, indent+2))
 		}
 		return "{}"
 
@@ -318,18 +448,30 @@ func formatType(props map[string]interface{}, indent int) string {
 // formatArguments formats a JSON string with custom value formatting.
 func formatArguments(arguments string) (string, error) {
 	var jsonObject map[string]interface{}
-	if err := json.Unmarshal([]byte(arguments), &jsonObject); err != nil {
+	if err := unmarshalNumbers(arguments, &jsonObject); err != nil {
 		return "", err
 	}
-	if len(jsonObject) == 0 {
-		return "{}\n", nil
-	}
 
 	// Arguments seem to be formatted "typescript" parameter style, without
 	// quotes around the keys.
 	return stringifyObject(jsonObject, false)
 }
 
+// unmarshalNumbers unmarshals JSON like json.Unmarshal, but decodes numbers
+// as json.Number so they're re-serialised as written rather than as float64,
+// which would render 1719155110 as 1.71915511e+09.
+func unmarshalNumbers(data string, v interface{}) error {
+	d := json.NewDecoder(strings.NewReader(data))
+	d.UseNumber()
+	if err := d.Decode(v); err != nil {
+		return err
+	}
+	if _, err := d.Token(); err != io.EOF {
+		return errors.New("invalid data after top-level value")
+	}
+	return nil
+}
+
 // stringifyObject returns a JSON-formatted string representation of the object.
 func stringifyObject(jsonObject map[string]interface{}, useQuotes bool) (string, error) {
 	if len(jsonObject) == 0 {
@@ -337,19 +479,35 @@ func stringifyObject(jsonObject map[string]interface{}, useQuotes bool) (string,
 	}
 
 	var properties []string
-	for fieldName, value := range jsonObject {
-		properties = append(properties, formatField(fieldName, value, useQuotes))
+	for _, fieldName := range sortedKeys(jsonObject) {
+		field, err := formatField(fieldName, jsonObject[fieldName], useQuotes)
+		if err != nil {
+			return "", err
+		}
+		properties = append(properties, field)
 	}
 
 	return fmt.Sprintf("{%s}", strings.Join(properties, ",")), nil
 }
 
-func formatField(fieldName string, value interface{}, useQuotes bool) string {
-	formattedValue, _ := formatValue(value, useQuotes)
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func formatField(fieldName string, value interface{}, useQuotes bool) (string, error) {
+	formattedValue, err := formatValue(value, useQuotes)
+	if err != nil {
+		return "", err
+	}
 	if useQuotes {
-		return fmt.Sprintf("%q:%s", fieldName, formattedValue)
+		return fmt.Sprintf("%q:%s", fieldName, formattedValue), nil
 	}
-	return fmt.Sprintf("%s:%s", fieldName, formattedValue)
+	return fmt.Sprintf("%s:%s", fieldName, formattedValue), nil
 }
 
 // formatValue returns a JSON-formatted string representation of the value.
@@ -357,6 +515,8 @@ func formatValue(value interface{}, useQuotes bool) (string, error) {
 	switch v := value.(type) {
 	case string:
 		return fmt.Sprintf("%q", v), nil
+	case json.Number:
+		return v.String(), nil
 	case float64, float32, int, int64, int32, int16, int8, uint, uint64, uint32, uint16, uint8, bool:
 		return fmt.Sprintf("%v", v), nil
 	case []interface{}:
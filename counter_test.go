@@ -20,6 +20,76 @@ func TestMain(m *testing.M) {
 	os.Exit(m.Run())
 }
 
+// skiWeatherTools is the tool used to compare each form of tool choice.
+var skiWeatherTools = []openai.Tool{{
+	Type: openai.ToolTypeFunction,
+	Function: &openai.FunctionDefinition{
+		Name:        "get_current_weather",
+		Description: "Get the current weather in a given location.",
+		Parameters: jsonschema.Definition{
+			Type: jsonschema.Object,
+			Properties: map[string]jsonschema.Definition{
+				"location": {
+					Type:        jsonschema.String,
+					Description: "The city and state, e.g. San Francisco, CA",
+				},
+				"unit": {
+					Type: jsonschema.String,
+					Enum: []string{"celsius", "fahrenheit"},
+				},
+			},
+			Required: []string{"location"},
+		},
+	},
+}}
+
+// deployTools has nested objects, with their own required fields and
+// descriptions, and an array of objects.
+var deployTools = []openai.Tool{{
+	Type: openai.ToolTypeFunction,
+	Function: &openai.FunctionDefinition{
+		Name:        "deploy",
+		Description: "Deploy a service.",
+		Parameters: jsonschema.Definition{
+			Type: jsonschema.Object,
+			Properties: map[string]jsonschema.Definition{
+				"config": {
+					Type:        jsonschema.Object,
+					Description: "The deployment configuration.",
+					Properties: map[string]jsonschema.Definition{
+						"region": {
+							Type:        jsonschema.String,
+							Description: "The region to deploy to.",
+						},
+						"replicas": {Type: jsonschema.Integer},
+						"limits": {
+							Type: jsonschema.Object,
+							Properties: map[string]jsonschema.Definition{
+								"cpu":    {Type: jsonschema.Number},
+								"memory": {Type: jsonschema.String},
+							},
+							Required: []string{"cpu"},
+						},
+					},
+					Required: []string{"region"},
+				},
+				"targets": {
+					Type: jsonschema.Array,
+					Items: &jsonschema.Definition{
+						Type: jsonschema.Object,
+						Properties: map[string]jsonschema.Definition{
+							"host": {Type: jsonschema.String},
+							"port": {Type: jsonschema.Integer},
+						},
+						Required: []string{"host"},
+					},
+				},
+			},
+			Required: []string{"config"},
+		},
+	},
+}}
+
 func TestCountRequestTokens(t *testing.T) {
 	tests := []struct {
 		name string
@@ -142,6 +212,62 @@ func TestCountRequestTokens(t *testing.T) {
 				},
 			},
 		},
+	}, {
+		name: "User message with one tool - tool choice none",
+		in: openai.ChatCompletionRequest{
+			Messages: []openai.ChatCompletionMessage{{
+				Role:    openai.ChatMessageRoleUser,
+				Content: "I want to ski at either Killington or Vail this weekend.",
+			}},
+			Tools:      skiWeatherTools,
+			ToolChoice: "none",
+		},
+	}, {
+		name: "User message with one tool - tool choice auto",
+		in: openai.ChatCompletionRequest{
+			Messages: []openai.ChatCompletionMessage{{
+				Role:    openai.ChatMessageRoleUser,
+				Content: "I want to ski at either Killington or Vail this weekend.",
+			}},
+			Tools:      skiWeatherTools,
+			ToolChoice: "auto",
+		},
+	}, {
+		name: "User message with one tool - tool choice required",
+		in: openai.ChatCompletionRequest{
+			Messages: []openai.ChatCompletionMessage{{
+				Role:    openai.ChatMessageRoleUser,
+				Content: "I want to ski at either Killington or Vail this weekend.",
+			}},
+			Tools:      skiWeatherTools,
+			ToolChoice: "required",
+		},
+	}, {
+		name: "User message with one tool - tool choice decoded from JSON",
+		in: openai.ChatCompletionRequest{
+			Messages: []openai.ChatCompletionMessage{{
+				Role:    openai.ChatMessageRoleUser,
+				Content: "I want to ski at either Killington or Vail this weekend.",
+			}},
+			Tools: skiWeatherTools,
+			ToolChoice: map[string]interface{}{
+				"type":     "function",
+				"function": map[string]interface{}{"name": "get_current_weather"},
+			},
+		},
+	}, {
+		name: "User message with one tool - tool choice pointer",
+		in: openai.ChatCompletionRequest{
+			Messages: []openai.ChatCompletionMessage{{
+				Role:    openai.ChatMessageRoleUser,
+				Content: "I want to ski at either Killington or Vail this weekend.",
+			}},
+			Tools: skiWeatherTools,
+			ToolChoice: &openai.ToolChoice{
+				Type:     openai.ToolTypeFunction,
+				Function: openai.ToolFunction{Name: "get_current_weather"},
+			},
+		},
 	}, {
 		name: "System and user message with one tool",
 		in: openai.ChatCompletionRequest{
@@ -261,6 +387,15 @@ func TestCountRequestTokens(t *testing.T) {
 			}},
 		},
 		wantCached: 94,
+	}, {
+		name: "User message with nested object tool",
+		in: openai.ChatCompletionRequest{
+			Messages: []openai.ChatCompletionMessage{{
+				Role:    openai.ChatMessageRoleUser,
+				Content: "Deploy the API to us-east-1 with two replicas.",
+			}},
+			Tools: deployTools,
+		},
 	}, {
 		name: "Assistant message with tool call then tool message",
 		in: openai.ChatCompletionRequest{
@@ -285,6 +420,146 @@ func TestCountRequestTokens(t *testing.T) {
 			}},
 		},
 		wantCached: 70,
+	}, {
+		// Sequential calls aren't wrapped in multi_tool_use.parallel, unlike
+		// two calls in one message.
+		name: "Two rounds of single tool calls",
+		in: openai.ChatCompletionRequest{
+			Messages: []openai.ChatCompletionMessage{{
+				Role:    openai.ChatMessageRoleUser,
+				Content: "Should I ski at Killington or Tremblant this weekend?",
+			}, {
+				Role: openai.ChatMessageRoleAssistant,
+				ToolCalls: []openai.ToolCall{{
+					ID:   "testcall_20240328_A",
+					Type: openai.ToolTypeFunction,
+					Function: openai.FunctionCall{
+						Name:      "get_current_weather",
+						Arguments: "{\"location\": \"Killington, VT\"}",
+					},
+				}},
+			}, {
+				Role:       openai.ChatMessageRoleTool,
+				Content:    "The weather in Killington, VT is 45 degrees.",
+				ToolCallID: "testcall_20240328_A",
+			}, {
+				Role: openai.ChatMessageRoleAssistant,
+				ToolCalls: []openai.ToolCall{{
+					ID:   "testcall_20240328_B",
+					Type: openai.ToolTypeFunction,
+					Function: openai.FunctionCall{
+						Name:      "get_current_weather",
+						Arguments: "{\"location\": \"Mount Tremblant, QC\"}",
+					},
+				}},
+			}, {
+				Role:       openai.ChatMessageRoleTool,
+				Content:    "The weather at Mount Tremblant, QC is 32 degrees.",
+				ToolCallID: "testcall_20240328_B",
+			}},
+		},
+	}, {
+		// The wrapper's tool_uses JSON grows with each parallel call.
+		name: "Assistant message with two parallel tool calls",
+		in: openai.ChatCompletionRequest{
+			Messages: []openai.ChatCompletionMessage{{
+				Role:    openai.ChatMessageRoleUser,
+				Content: "Where should I ski this weekend?",
+			}, {
+				Role: openai.ChatMessageRoleAssistant,
+				ToolCalls: []openai.ToolCall{{
+					ID:   "testcall_20240330_A",
+					Type: openai.ToolTypeFunction,
+					Function: openai.FunctionCall{
+						Name:      "get_current_weather",
+						Arguments: "{\"location\": \"Killington, VT\"}",
+					},
+				}, {
+					ID:   "testcall_20240330_B",
+					Type: openai.ToolTypeFunction,
+					Function: openai.FunctionCall{
+						Name:      "get_current_weather",
+						Arguments: "{\"location\": \"Mount Tremblant, QC\"}",
+					},
+				}},
+			}, {
+				Role:       openai.ChatMessageRoleTool,
+				Content:    "30 degrees.",
+				ToolCallID: "testcall_20240330_A",
+			}, {
+				Role:       openai.ChatMessageRoleTool,
+				Content:    "31 degrees.",
+				ToolCallID: "testcall_20240330_B",
+			}},
+			Tools: skiWeatherTools,
+		},
+	}, {
+		name: "Assistant message with three parallel tool calls",
+		in: openai.ChatCompletionRequest{
+			Messages: []openai.ChatCompletionMessage{{
+				Role:    openai.ChatMessageRoleUser,
+				Content: "Where should I ski this weekend?",
+			}, {
+				Role: openai.ChatMessageRoleAssistant,
+				ToolCalls: []openai.ToolCall{{
+					ID:   "testcall_20240330_A",
+					Type: openai.ToolTypeFunction,
+					Function: openai.FunctionCall{
+						Name:      "get_current_weather",
+						Arguments: "{\"location\": \"Killington, VT\"}",
+					},
+				}, {
+					ID:   "testcall_20240330_B",
+					Type: openai.ToolTypeFunction,
+					Function: openai.FunctionCall{
+						Name:      "get_current_weather",
+						Arguments: "{\"location\": \"Mount Tremblant, QC\"}",
+					},
+				}, {
+					ID:   "testcall_20240330_C",
+					Type: openai.ToolTypeFunction,
+					Function: openai.FunctionCall{
+						Name:      "get_current_weather",
+						Arguments: "{\"location\": \"Stowe, VT\"}",
+					},
+				}},
+			}, {
+				Role:       openai.ChatMessageRoleTool,
+				Content:    "30 degrees.",
+				ToolCallID: "testcall_20240330_A",
+			}, {
+				Role:       openai.ChatMessageRoleTool,
+				Content:    "31 degrees.",
+				ToolCallID: "testcall_20240330_B",
+			}, {
+				Role:       openai.ChatMessageRoleTool,
+				Content:    "32 degrees.",
+				ToolCallID: "testcall_20240330_C",
+			}},
+			Tools: skiWeatherTools,
+		},
+	}, {
+		name: "Assistant message with tool call then JSON array tool content",
+		in: openai.ChatCompletionRequest{
+			Messages: []openai.ChatCompletionMessage{{
+				Role:    openai.ChatMessageRoleUser,
+				Content: "Find ski resorts near Denver.",
+			}, {
+				Role: openai.ChatMessageRoleAssistant,
+				ToolCalls: []openai.ToolCall{{
+					ID:   "testcall_20240329",
+					Type: openai.ToolTypeFunction,
+					Function: openai.FunctionCall{
+						Name:      "web_search",
+						Arguments: "{\"query\": \"ski resorts near Denver\"}",
+					},
+				}},
+			}, {
+				Role:       openai.ChatMessageRoleTool,
+				Content:    "[{\"title\": \"Winter Park\", \"miles\": 67}, {\"title\": \"Loveland\", \"miles\": 56}]",
+				ToolCallID: "testcall_20240329",
+			}},
+		},
 	}, {
 		name: "Assistant message with tool call then 1 tool content property",
 		in: openai.ChatCompletionRequest{
@@ -473,40 +748,6 @@ func TestCountRequestTokens(t *testing.T) {
 		//		},
 		//		wantCached: 80,
 		//	}, {
-		//		name: "Assistant message with two tool call then two tool messages",
-		//		in: openai.ChatCompletionRequest{
-		//			Messages: []openai.ChatCompletionMessage{{
-		//				Role:    openai.ChatMessageRoleUser,
-		//				Content: "Should I ski at Killington or Tremblant this weekend?",
-		//			}, {
-		//				Role: openai.ChatMessageRoleAssistant,
-		//				ToolCalls: []openai.ToolCall{{
-		//					ID:   "testcall_20240328_A",
-		//					Type: openai.ToolTypeFunction,
-		//					Function: openai.FunctionCall{
-		//						Name:      "get_current_weather",
-		//						Arguments: "{\"location\": \"Killington, VT\"}",
-		//					},
-		//				}, {
-		//					ID:   "testcall_20240328_B",
-		//					Type: openai.ToolTypeFunction,
-		//					Function: openai.FunctionCall{
-		//						Name:      "get_current_weather",
-		//						Arguments: "{\"location\": \"Mount Tremblant, QC\"}",
-		//					},
-		//				}},
-		//			}, {
-		//				Role:       openai.ChatMessageRoleTool,
-		//				Content:    "The weather in Killington, VT is 45 degrees.",
-		//				ToolCallID: "testcall_20240328_A",
-		//			}, {
-		//				Role:       openai.ChatMessageRoleTool,
-		//				Content:    "The weather at Mount Tremblant, QC is 32 degrees.",
-		//				ToolCallID: "testcall_20240328_B",
-		//			}},
-		//		},
-		//		wantCached: 111,
-		//	}, {
 		//		name: "Assistant message with two JSON tool content messages",
 		//		in: openai.ChatCompletionRequest{
 		//			Messages: []openai.ChatCompletionMessage{{
@@ -542,6 +783,63 @@ func TestCountRequestTokens(t *testing.T) {
 		//		},
 		//		wantCached: 159,
 		//	}, {
+		name: "Assistant message with two tool call then two tool messages",
+		in: openai.ChatCompletionRequest{
+			Messages: []openai.ChatCompletionMessage{{
+				Role:    openai.ChatMessageRoleUser,
+				Content: "Should I ski at Killington or Tremblant this weekend?",
+			}, {
+				Role: openai.ChatMessageRoleAssistant,
+				ToolCalls: []openai.ToolCall{{
+					ID:   "testcall_20240328_A",
+					Type: openai.ToolTypeFunction,
+					Function: openai.FunctionCall{
+						Name:      "get_current_weather",
+						Arguments: "{\"location\": \"Killington, VT\"}",
+					},
+				}, {
+					ID:   "testcall_20240328_B",
+					Type: openai.ToolTypeFunction,
+					Function: openai.FunctionCall{
+						Name:      "get_current_weather",
+						Arguments: "{\"location\": \"Mount Tremblant, QC\"}",
+					},
+				}},
+			}, {
+				Role:       openai.ChatMessageRoleTool,
+				Content:    "The weather in Killington, VT is 45 degrees.",
+				ToolCallID: "testcall_20240328_A",
+			}, {
+				Role:       openai.ChatMessageRoleTool,
+				Content:    "The weather at Mount Tremblant, QC is 32 degrees.",
+				ToolCallID: "testcall_20240328_B",
+			}},
+		},
+		wantCached: 111,
+	}, {
+		name: "Assistant message with deeply nested tool call arguments",
+		in: openai.ChatCompletionRequest{
+			Messages: []openai.ChatCompletionMessage{{
+				Role:    openai.ChatMessageRoleUser,
+				Content: "Deploy the API to us-east-1 with two replicas.",
+			}, {
+				Role: openai.ChatMessageRoleAssistant,
+				ToolCalls: []openai.ToolCall{{
+					ID:   "testcall_20240330",
+					Type: openai.ToolTypeFunction,
+					Function: openai.FunctionCall{
+						Name:      "deploy",
+						Arguments: "{\"config\": {\"region\": \"us-east-1\", \"replicas\": 2, \"limits\": {\"cpu\": 0.5, \"memory\": \"512Mi\"}}, \"targets\": [{\"host\": \"api.example.com\", \"port\": 443}]}",
+					},
+				}},
+			}, {
+				Role:       openai.ChatMessageRoleTool,
+				Content:    "{\"status\": \"deployed\"}",
+				ToolCallID: "testcall_20240330",
+			}},
+			Tools: deployTools,
+		},
+	}, {
 		name: "Problem example from testing",
 		in: openai.ChatCompletionRequest{
 			Messages: []openai.ChatCompletionMessage{{
@@ -645,181 +943,509 @@ func TestCountRequestTokens(t *testing.T) {
 	}
 }
 
-//func TestCountResponseTokens(t *testing.T) {
-//	tests := []struct {
-//		name  string
-//		model string
-//		in    openai.ChatCompletionResponse
-//		want  int
-//	}{{
-//		name:  "Single complete message",
-//		model: "gpt-4o-2024-05-13",
-//		in: openai.ChatCompletionResponse{
-//			ID:      "chatcmpl-9dJ4AhT4Nw5Z5gqDfjvw1ZNFo96YA",
-//			Object:  "chat.completion",
-//			Created: 1719155110,
-//			Model:   "gpt-4o-2024-05-13",
-//			Choices: []openai.ChatCompletionChoice{{
-//				Index: 0,
-//				Message: openai.ChatCompletionMessage{
-//					Role:    openai.ChatMessageRoleAssistant,
-//					Content: "That sounds like a fun plan! To help you prepare, it's important to check the current weather conditions at Killington, VT. Would you like me to get the current weather information for you?",
-//				},
-//				FinishReason: "stop",
-//			}},
-//			Usage: openai.Usage{
-//				PromptTokens:     71,
-//				CompletionTokens: 40,
-//				TotalTokens:      111,
-//			},
-//			SystemFingerprint: "fp_5e6c71d4a8",
-//		},
-//		want: 40,
-//	}, {
-//		name:  "Single complete message with tool call",
-//		model: "gpt-4o-2024-05-13",
-//		in: openai.ChatCompletionResponse{
-//			ID:      "chatcmpl-9dTOqwCsAwEKCL1NywpjNrydfgTnD",
-//			Object:  "chat.completion",
-//			Created: 1719194832,
-//			Model:   "gpt-4o-2024-05-13",
-//			Choices: []openai.ChatCompletionChoice{{
-//				Index: 0,
-//				Message: openai.ChatCompletionMessage{
-//					Role:    openai.ChatMessageRoleAssistant,
-//					Content: "Let's check the current weather at Killington, VT to help you decide if skiing this weekend is viable.",
-//					ToolCalls: []openai.ToolCall{{
-//						ID:   "call_XtkMPwjzUOnjvQYDbiQPi9ST",
-//						Type: openai.ToolTypeFunction,
-//						Function: openai.FunctionCall{
-//							Name:      "get_current_weather",
-//							Arguments: "{\"location\":\"Killington, VT\"}",
-//						},
-//					}},
-//				},
-//				FinishReason: "tool_calls",
-//			}},
-//			Usage: openai.Usage{
-//				PromptTokens:     71,
-//				CompletionTokens: 40,
-//				TotalTokens:      111,
-//			},
-//			SystemFingerprint: "fp_3e7d703517",
-//		},
-//		want: 40,
-//	}, {
-//		name:  "Single complete message with tool call - variant",
-//		model: "gpt-4o-2024-05-13",
-//		in: openai.ChatCompletionResponse{
-//			ID:      "chatcmpl-9dTXl2qLHZ7eqgq4cWjdq3sBL1Ujh",
-//			Object:  "chat.completion",
-//			Created: 1719195385,
-//			Model:   "gpt-4o-2024-05-13",
-//			Choices: []openai.ChatCompletionChoice{{
-//				Index: 0,
-//				Message: openai.ChatCompletionMessage{
-//					Role:    openai.ChatMessageRoleAssistant,
-//					Content: "That sounds like a lot of fun! Before planning your ski trip, let's check the weather at Killington, VT for this weekend.",
-//					ToolCalls: []openai.ToolCall{{
-//						ID:   "call_asoYc09Lgcm6K0HGHDgI4ECd",
-//						Type: openai.ToolTypeFunction,
-//						Function: openai.FunctionCall{
-//							Name:      "get_current_weather",
-//							Arguments: "{\"location\": \"Killington, VT\"}",
-//						},
-//					}},
-//				},
-//				FinishReason: "tool_calls",
-//			}},
-//			Usage: openai.Usage{
-//				PromptTokens:     71,
-//				CompletionTokens: 62,
-//				TotalTokens:      133,
-//			},
-//			SystemFingerprint: "fp_3e7d703517",
-//		},
-//		want: 62,
-//	}, {
-//		name:  "Single complete message with two tool calls",
-//		model: "gpt-4o-2024-05-13",
-//		in: openai.ChatCompletionResponse{
-//			ID:      "chatcmpl-9dJ4B30gKE8br1vjbqTxeHnSe3RRV",
-//			Object:  "chat.completion",
-//			Created: 1719155111,
-//			Model:   "gpt-4o-2024-05-13",
-//			Choices: []openai.ChatCompletionChoice{{
-//				Index: 0,
-//				Message: openai.ChatCompletionMessage{
-//					Role:    openai.ChatMessageRoleAssistant,
-//					Content: "I'll get the current weather for both Killington, VT, and Vail, CO to help you decide where to ski this weekend.",
-//					ToolCalls: []openai.ToolCall{{
-//						ID:   "call_XJVrmo98o69BpRDldhLqRCvi",
-//						Type: openai.ToolTypeFunction,
-//						Function: openai.FunctionCall{
-//							Name:      "get_current_weather",
-//							Arguments: "{\"location\": \"Killington, VT\", \"unit\": \"fahrenheit\"}",
-//						},
-//					}, {
-//						ID:   "call_5n958M9taJkwvTFLidR5e29S",
-//						Type: openai.ToolTypeFunction,
-//						Function: openai.FunctionCall{
-//							Name:      "get_current_weather",
-//							Arguments: "{\"location\": \"Vail, CO\", \"unit\": \"fahrenheit\"}",
-//						},
-//					}},
-//				},
-//				FinishReason: "tool_calls",
-//			}},
-//			Usage: openai.Usage{
-//				PromptTokens:     86,
-//				CompletionTokens: 90,
-//				TotalTokens:      176,
-//			},
-//			SystemFingerprint: "fp_888385ccad",
-//		},
-//		want: 90,
-//	}, {
-//		name:  "Simple assistant message",
-//		model: "gpt-4o-2024-05-13",
-//		in: openai.ChatCompletionResponse{
-//			ID:      "chatcmpl-9dTiR4eT5KtboJ1M1O15AKKXTefan",
-//			Object:  "chat.completion",
-//			Created: 1719196047,
-//			Model:   "gpt-4o-2024-05-13",
-//			Choices: []openai.ChatCompletionChoice{{
-//				Index: 0,
-//				Message: openai.ChatCompletionMessage{
-//					Role:    openai.ChatMessageRoleAssistant,
-//					Content: "How can I assist you today?",
-//				},
-//				FinishReason: "stop",
-//			}},
-//			Usage: openai.Usage{
-//				PromptTokens:     13,
-//				CompletionTokens: 7,
-//				TotalTokens:      20,
-//			},
-//			SystemFingerprint: "fp_5e6c71d4a8",
-//		},
-//		want: 7,
-//	}}
-//
-//	for _, tt := range tests {
-//		counter, err := NewCounter(tt.model)
-//		if err != nil {
-//			t.Fatalf("NewCounter: %v", err)
-//		}
-//
-//		got := counter.CountResponseTokens(tt.in)
-//		if got != tt.want {
-//			t.Errorf(
-//				"%s - %s: got %d, want %d, diff %d",
-//				tt.name,
-//				tt.model,
-//				got,
-//				tt.want,
-//				got-tt.want,
-//			)
-//		}
-//	}
-//}
+// TestToolChoiceOverhead derives the cost of each tool choice from the
+// difference between the API's prompt_tokens for the same request with that
+// choice and with "auto".
+func TestToolChoiceOverhead(t *testing.T) {
+	counter, err := NewCounter(openai.GPT4o)
+	if err != nil {
+		t.Fatalf("NewCounter: %v", err)
+	}
+	named := toolChoice{mode: toolChoiceFunction, name: "get_current_weather"}
+	tests := []struct {
+		name   string
+		choice any
+		want   int
+	}{
+		{name: "none", choice: "none", want: tokensForToolChoiceNone},
+		{name: "required", choice: "required", want: tokensForToolChoiceRequired},
+		{name: "function", choice: openai.ToolChoice{
+			Type:     openai.ToolTypeFunction,
+			Function: openai.ToolFunction{Name: "get_current_weather"},
+		}, want: len(counter.encodeToolChoice(named))},
+	}
+
+	client := openai.NewClient(openaiKey)
+	promptTokens := func(choice any) int {
+		req := openai.ChatCompletionRequest{
+			Model: openai.GPT4o,
+			Messages: []openai.ChatCompletionMessage{{
+				Role:    openai.ChatMessageRoleUser,
+				Content: "I want to ski at either Killington or Vail this weekend.",
+			}},
+			Tools:       skiWeatherTools,
+			ToolChoice:  choice,
+			MaxTokens:   1,
+			Temperature: 0.0,
+		}
+		resp, err := client.CreateChatCompletion(context.Background(), req)
+		if err != nil {
+			t.Fatalf("tool choice %v: CreateChatCompletion: %v", choice, err)
+		}
+		return resp.Usage.PromptTokens
+	}
+
+	auto := promptTokens("auto")
+	t.Logf("auto: %d prompt tokens", auto)
+	for _, tt := range tests {
+		got := promptTokens(tt.choice)
+		t.Logf("%s: %d prompt tokens", tt.name, got)
+		if got-auto != tt.want {
+			t.Errorf("%s: costs %d tokens more than auto, counted as %d", tt.name, got-auto, tt.want)
+		}
+	}
+}
+
+// TestCountRequestTokensTypeScript checks tool calls in the history against
+// the models that render them in TypeScript args format. They have no recorded
+// counts yet, so the rendering is only checked with -openai-key; offline,
+// TestEncodeToolCall checks each call's rendering.
+func TestCountRequestTokensTypeScript(t *testing.T) {
+	call := func(id, name, arguments string) openai.ToolCall {
+		return openai.ToolCall{
+			ID:       id,
+			Type:     openai.ToolTypeFunction,
+			Function: openai.FunctionCall{Name: name, Arguments: arguments},
+		}
+	}
+	result := func(id, content string) openai.ChatCompletionMessage {
+		return openai.ChatCompletionMessage{Role: openai.ChatMessageRoleTool, Content: content, ToolCallID: id}
+	}
+	listResorts := openai.Tool{
+		Type: openai.ToolTypeFunction,
+		Function: &openai.FunctionDefinition{
+			Name:        "list_resorts",
+			Description: "List the open ski resorts.",
+			Parameters:  jsonschema.Definition{Type: jsonschema.Object, Properties: map[string]jsonschema.Definition{}},
+		},
+	}
+
+	tests := []struct {
+		name string
+		in   openai.ChatCompletionRequest
+	}{{
+		name: "Single tool call",
+		in: openai.ChatCompletionRequest{
+			Messages: []openai.ChatCompletionMessage{
+				{Role: openai.ChatMessageRoleUser, Content: "I want to ski at Vail this weekend."},
+				{Role: openai.ChatMessageRoleAssistant, ToolCalls: []openai.ToolCall{
+					call("testcall_20240401", "get_current_weather", "{\"location\": \"Vail, CO\"}"),
+				}},
+				result("testcall_20240401", "{\"temperature\": \"35\"}"),
+			},
+			Tools: skiWeatherTools,
+		},
+	}, {
+		name: "Parallel tool calls",
+		in: openai.ChatCompletionRequest{
+			Messages: []openai.ChatCompletionMessage{
+				{Role: openai.ChatMessageRoleUser, Content: "Should I ski at Killington or Tremblant this weekend?"},
+				{Role: openai.ChatMessageRoleAssistant, ToolCalls: []openai.ToolCall{
+					call("testcall_20240402_A", "get_current_weather", "{\"location\": \"Killington, VT\"}"),
+					call("testcall_20240402_B", "get_current_weather", "{\"location\": \"Mount Tremblant, QC\"}"),
+				}},
+				result("testcall_20240402_A", "The weather in Killington, VT is 45 degrees."),
+				result("testcall_20240402_B", "The weather at Mount Tremblant, QC is 32 degrees."),
+			},
+			Tools: skiWeatherTools,
+		},
+	}, {
+		name: "Tool call with empty arguments",
+		in: openai.ChatCompletionRequest{
+			Messages: []openai.ChatCompletionMessage{
+				{Role: openai.ChatMessageRoleUser, Content: "Which resorts are open?"},
+				{Role: openai.ChatMessageRoleAssistant, ToolCalls: []openai.ToolCall{
+					call("testcall_20240403", "list_resorts", "{}"),
+				}},
+				result("testcall_20240403", "[\"Vail\", \"Breckenridge\"]"),
+			},
+			Tools: []openai.Tool{listResorts},
+		},
+	}, {
+		name: "Tool call with nested arguments",
+		in: openai.ChatCompletionRequest{
+			Messages: []openai.ChatCompletionMessage{
+				{Role: openai.ChatMessageRoleUser, Content: "Deploy the API to us-east-1 with two replicas."},
+				{Role: openai.ChatMessageRoleAssistant, ToolCalls: []openai.ToolCall{
+					call("testcall_20240404", "deploy", "{\"config\": {\"region\": \"us-east-1\", \"replicas\": 2, \"limits\": {\"cpu\": 0.5, \"memory\": \"512Mi\"}}, \"targets\": [{\"host\": \"api.example.com\", \"port\": 443}]}"),
+				}},
+				result("testcall_20240404", "{\"status\": \"deployed\"}"),
+			},
+			Tools: deployTools,
+		},
+	}}
+
+	client := openai.NewClient(openaiKey)
+	models := []string{
+		openai.GPT4,
+		openai.GPT4Turbo,
+		openai.GPT3Dot5Turbo,
+	}
+
+	for _, model := range models {
+		counter, err := NewCounter(model)
+		if err != nil {
+			t.Fatalf("NewCounter: %v", err)
+		}
+		for _, tt := range tests {
+			req := tt.in
+			req.Model = model
+			req.MaxTokens = 150
+			req.Temperature = 0.0
+
+			resp, err := client.CreateChatCompletion(context.Background(), req)
+			if err != nil {
+				t.Fatalf("%s - %s: CreateChatCompletion: %v", tt.name, model, err)
+			}
+
+			got := counter.CountRequestTokens(tt.in)
+			if want := resp.Usage.PromptTokens; got != want {
+				t.Errorf(
+					"%s - %s: prompt token count got %d, want %d, diff %d",
+					tt.name,
+					model,
+					got,
+					want,
+					got-want,
+				)
+			}
+		}
+	}
+}
+
+func TestCountResponseTokens(t *testing.T) {
+	tests := []struct {
+		name  string
+		model string
+		in    openai.ChatCompletionResponse
+		want  int
+	}{{
+		name:  "Single complete message",
+		model: "gpt-4o-2024-05-13",
+		in: openai.ChatCompletionResponse{
+			ID:      "chatcmpl-9dJ4AhT4Nw5Z5gqDfjvw1ZNFo96YA",
+			Object:  "chat.completion",
+			Created: 1719155110,
+			Model:   "gpt-4o-2024-05-13",
+			Choices: []openai.ChatCompletionChoice{{
+				Index: 0,
+				Message: openai.ChatCompletionMessage{
+					Role:    openai.ChatMessageRoleAssistant,
+					Content: "That sounds like a fun plan! To help you prepare, it's important to check the current weather conditions at Killington, VT. Would you like me to get the current weather information for you?",
+				},
+				FinishReason: "stop",
+			}},
+			Usage: openai.Usage{
+				PromptTokens:     71,
+				CompletionTokens: 40,
+				TotalTokens:      111,
+			},
+			SystemFingerprint: "fp_5e6c71d4a8",
+		},
+		want: 40,
+	}, {
+		name:  "Single complete message with tool call",
+		model: "gpt-4o-2024-05-13",
+		in: openai.ChatCompletionResponse{
+			ID:      "chatcmpl-9dTOqwCsAwEKCL1NywpjNrydfgTnD",
+			Object:  "chat.completion",
+			Created: 1719194832,
+			Model:   "gpt-4o-2024-05-13",
+			Choices: []openai.ChatCompletionChoice{{
+				Index: 0,
+				Message: openai.ChatCompletionMessage{
+					Role:    openai.ChatMessageRoleAssistant,
+					Content: "Let's check the current weather at Killington, VT to help you decide if skiing this weekend is viable.",
+					ToolCalls: []openai.ToolCall{{
+						ID:   "call_XtkMPwjzUOnjvQYDbiQPi9ST",
+						Type: openai.ToolTypeFunction,
+						Function: openai.FunctionCall{
+							Name:      "get_current_weather",
+							Arguments: "{\"location\":\"Killington, VT\"}",
+						},
+					}},
+				},
+				FinishReason: "tool_calls",
+			}},
+			Usage: openai.Usage{
+				PromptTokens:     71,
+				CompletionTokens: 40,
+				TotalTokens:      111,
+			},
+			SystemFingerprint: "fp_3e7d703517",
+		},
+		want: 40,
+	}, {
+		name:  "Single complete message with tool call - variant",
+		model: "gpt-4o-2024-05-13",
+		in: openai.ChatCompletionResponse{
+			ID:      "chatcmpl-9dTXl2qLHZ7eqgq4cWjdq3sBL1Ujh",
+			Object:  "chat.completion",
+			Created: 1719195385,
+			Model:   "gpt-4o-2024-05-13",
+			Choices: []openai.ChatCompletionChoice{{
+				Index: 0,
+				Message: openai.ChatCompletionMessage{
+					Role:    openai.ChatMessageRoleAssistant,
+					Content: "That sounds like a lot of fun! Before planning your ski trip, let's check the weather at Killington, VT for this weekend.",
+					ToolCalls: []openai.ToolCall{{
+						ID:   "call_asoYc09Lgcm6K0HGHDgI4ECd",
+						Type: openai.ToolTypeFunction,
+						Function: openai.FunctionCall{
+							Name:      "get_current_weather",
+							Arguments: "{\"location\": \"Killington, VT\"}",
+						},
+					}},
+				},
+				FinishReason: "tool_calls",
+			}},
+			Usage: openai.Usage{
+				PromptTokens:     71,
+				CompletionTokens: 62,
+				TotalTokens:      133,
+			},
+			SystemFingerprint: "fp_3e7d703517",
+		},
+		want: 62,
+	}, {
+		name:  "Single complete message with two tool calls",
+		model: "gpt-4o-2024-05-13",
+		in: openai.ChatCompletionResponse{
+			ID:      "chatcmpl-9dJ4B30gKE8br1vjbqTxeHnSe3RRV",
+			Object:  "chat.completion",
+			Created: 1719155111,
+			Model:   "gpt-4o-2024-05-13",
+			Choices: []openai.ChatCompletionChoice{{
+				Index: 0,
+				Message: openai.ChatCompletionMessage{
+					Role:    openai.ChatMessageRoleAssistant,
+					Content: "I'll get the current weather for both Killington, VT, and Vail, CO to help you decide where to ski this weekend.",
+					ToolCalls: []openai.ToolCall{{
+						ID:   "call_XJVrmo98o69BpRDldhLqRCvi",
+						Type: openai.ToolTypeFunction,
+						Function: openai.FunctionCall{
+							Name:      "get_current_weather",
+							Arguments: "{\"location\": \"Killington, VT\", \"unit\": \"fahrenheit\"}",
+						},
+					}, {
+						ID:   "call_5n958M9taJkwvTFLidR5e29S",
+						Type: openai.ToolTypeFunction,
+						Function: openai.FunctionCall{
+							Name:      "get_current_weather",
+							Arguments: "{\"location\": \"Vail, CO\", \"unit\": \"fahrenheit\"}",
+						},
+					}},
+				},
+				FinishReason: "tool_calls",
+			}},
+			Usage: openai.Usage{
+				PromptTokens:     86,
+				CompletionTokens: 90,
+				TotalTokens:      176,
+			},
+			SystemFingerprint: "fp_888385ccad",
+		},
+		want: 90,
+	}, {
+		name:  "Simple assistant message",
+		model: "gpt-4o-2024-05-13",
+		in: openai.ChatCompletionResponse{
+			ID:      "chatcmpl-9dTiR4eT5KtboJ1M1O15AKKXTefan",
+			Object:  "chat.completion",
+			Created: 1719196047,
+			Model:   "gpt-4o-2024-05-13",
+			Choices: []openai.ChatCompletionChoice{{
+				Index: 0,
+				Message: openai.ChatCompletionMessage{
+					Role:    openai.ChatMessageRoleAssistant,
+					Content: "How can I assist you today?",
+				},
+				FinishReason: "stop",
+			}},
+			Usage: openai.Usage{
+				PromptTokens:     13,
+				CompletionTokens: 7,
+				TotalTokens:      20,
+			},
+			SystemFingerprint: "fp_5e6c71d4a8",
+		},
+		want: 7,
+	}}
+
+	for _, tt := range tests {
+		counter, err := NewCounter(tt.model)
+		if err != nil {
+			t.Fatalf("NewCounter: %v", err)
+		}
+
+		got := counter.CountResponseTokens(tt.in)
+		if got != tt.want {
+			t.Errorf(
+				"%s - %s: got %d, want %d, diff %d",
+				tt.name,
+				tt.model,
+				got,
+				tt.want,
+				got-tt.want,
+			)
+		}
+	}
+}
+
+func TestFormatFunctionDefinitions(t *testing.T) {
+	got := formatFunctionDefinitions(toolDefsFromOpenAI(deployTools))
+	want := `# Tools
+## functions
+namespace functions {
+// Deploy a service.
+type deploy = (_: {
+// The deployment configuration.
+config:{
+  limits?:{
+    cpu:number,
+    memory?:string,
+},
+  // The region to deploy to.
+  region:string,
+  replicas?:number,
+},
+targets?:{
+  host:string,
+  port?:number,
+}[],
+}) => any;
+} // namespace functions`
+	if got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestFormatToolContent(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{in: `The weather is sunny.`, want: `"text": "The weather is sunny."`},
+		{in: `{"b": 1, "a": {"d": [true, null], "c": "x"}}`, want: `{"a":{"c":"x","d":[true,null]},"b":1}`},
+		{in: `[{"title": "Winter Park", "miles": 67}, 2]`, want: `[{"miles":67,"title":"Winter Park"},2]`},
+		{in: `42.5`, want: `42.5`},
+		{in: `1719155110`, want: `1719155110`},
+		{in: `{"id": 12345678, "score": -0.25, "big": 12345678901234567890}`, want: `{"big":12345678901234567890,"id":12345678,"score":-0.25}`},
+		{in: `[1e3, 1E-7]`, want: `[1e3,1E-7]`},
+		{in: `{"id": 1} trailing`, want: `"text": "{\"id\": 1} trailing"`},
+		{in: ` false `, want: `false`},
+		{in: `null`, want: `null`},
+		{in: `"quoted"`, want: `"text": "\"quoted\""`},
+		{in: ``, want: `"text": ""`},
+	}
+	for _, tt := range tests {
+		if got := formatToolContent(tt.in); got != tt.want {
+			t.Errorf("formatToolContent(%q): got %s, want %s", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestToolContentParts(t *testing.T) {
+	c := newTestCounter(t, openai.GPT4o)
+
+	content := openai.ChatCompletionMessage{
+		Role:       openai.ChatMessageRoleTool,
+		Content:    `[{"title": "Winter Park"}]`,
+		ToolCallID: "call_1",
+	}
+	parts := openai.ChatCompletionMessage{
+		Role: openai.ChatMessageRoleTool,
+		MultiContent: []openai.ChatMessagePart{
+			{Type: openai.ChatMessagePartTypeText, Text: `[{"title": `},
+			{Type: openai.ChatMessagePartTypeText, Text: `"Winter Park"}]`},
+		},
+		ToolCallID: "call_1",
+	}
+	if got, want := c.CountMessageTokens(parts), c.CountMessageTokens(content); got != want {
+		t.Errorf("got %d, want %d", got, want)
+	}
+}
+
+func TestEncodeToolCall(t *testing.T) {
+	calls := []struct {
+		name string
+		call toolCall
+		json string
+		ts   string
+	}{{
+		name: "Single",
+		call: toolCall{name: "get_current_weather", arguments: `{"location": "Vail, CO"}`},
+		json: `"name":"get_current_weather", "arguments":"{\"location\": \"Vail, CO\"}"`,
+		ts:   `functions.get_current_weather{location:"Vail, CO"}`,
+	}, {
+		name: "Empty arguments",
+		call: toolCall{name: "list_resorts", arguments: `{}`},
+		json: `"name":"list_resorts", "arguments":"{}"`,
+		ts:   `functions.list_resorts{}`,
+	}, {
+		name: "Nested",
+		call: toolCall{name: "deploy", arguments: `{"targets": [{"port": 443, "host": "a"}], "config": {"limits": {"cpu": 0.5}}}`},
+		json: `"name":"deploy", "arguments":"{\"targets\": [{\"port\": 443, \"host\": \"a\"}], \"config\": {\"limits\": {\"cpu\": 0.5}}}"`,
+		ts:   `functions.deploy{config:{limits:{cpu:0.5}},targets:[{host:"a",port:443}]}`,
+	}, {
+		name: "Large numbers",
+		call: toolCall{name: "get_order", arguments: `{"id": 12345678, "since": 1719155110}`},
+		json: `"name":"get_order", "arguments":"{\"id\": 12345678, \"since\": 1719155110}"`,
+		ts:   `functions.get_order{id:12345678,since:1719155110}`,
+	}, {
+		name: "Invalid arguments",
+		call: toolCall{name: "f", arguments: `{"a":`},
+		json: `"name":"f", "arguments":"{\"a\":"`,
+		ts:   `functions.f{"a":`,
+	}}
+
+	for _, tt := range calls {
+		for _, format := range []ToolCallFormat{ToolCallJSON, ToolCallTypeScript} {
+			c, err := NewCounter(openai.GPT4o, WithTokenizer(runeTokenizer{}), WithToolCallFormat(format))
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := tt.json
+			if format == ToolCallTypeScript {
+				want = tt.ts
+			}
+			if got := (runeTokenizer{}).Decode(c.encodeToolCall(tt.call)); got != want {
+				t.Errorf("%s in format %d: got %s, want %s", tt.name, format, got, want)
+			}
+		}
+	}
+
+	// Parallel calls are rendered as the JSON of the wrapper they're made
+	// through, whatever the message's format.
+	c, err := NewCounter(openai.GPT4Turbo, WithTokenizer(runeTokenizer{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	message := openai.ChatCompletionMessage{
+		Role: openai.ChatMessageRoleAssistant,
+		ToolCalls: []openai.ToolCall{
+			{Function: openai.FunctionCall{Name: "f", Arguments: `{"a":1}`}},
+			{Function: openai.FunctionCall{Name: "g", Arguments: `{}`}},
+		},
+	}
+	want := len("assistant") + 8 + len("multi_tool_use.parallel") +
+		len(`{"tool_uses":[{"recipient_name":"functions.f","parameters":{"a":1}},{"recipient_name":"functions.g","parameters":{}}]}`)
+	if got := c.CountMessageTokens(message); got != want {
+		t.Errorf("parallel: got %d, want %d", got, want)
+	}
+}
+
+func TestToolCallFormatFor(t *testing.T) {
+	tests := map[string]ToolCallFormat{
+		openai.GPT4o:             ToolCallJSON,
+		"gpt-4o-mini-2024-07-18": ToolCallJSON,
+		openai.GPT4Turbo20240409: ToolCallTypeScript,
+		openai.GPT40613:          ToolCallTypeScript,
+		openai.GPT3Dot5Turbo0125: ToolCallTypeScript,
+	}
+	for model, want := range tests {
+		if got := toolCallFormatFor(model); got != want {
+			t.Errorf("%s: got %d, want %d", model, got, want)
+		}
+	}
+}
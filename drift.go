@@ -0,0 +1,229 @@
+package tokens
+
+import (
+	"math"
+	"sort"
+	"sync"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+// DriftFeature is a kind of request whose estimates are tracked separately,
+// since a change to OpenAI's hidden prompt format usually affects only the
+// requests that use the changed part.
+type DriftFeature string
+
+const (
+	// DriftAll tracks every request.
+	DriftAll          DriftFeature = "all"
+	DriftTools        DriftFeature = "tools"
+	DriftToolMessages DriftFeature = "tool_messages"
+	DriftImages       DriftFeature = "images"
+)
+
+// DriftKey identifies the requests a DriftStats covers.
+type DriftKey struct {
+	Model   string
+	Feature DriftFeature
+}
+
+// DriftStats is the distribution of the relative error of prompt token
+// estimates, (estimate - reported) / reported, over the most recent samples.
+type DriftStats struct {
+	Samples int `json:"samples"`
+	// MeanError is signed, so a consistent under or over count shows up
+	// even when it's small.
+	MeanError float64 `json:"mean_error"`
+	// Percentiles are of the absolute error.
+	P50Error float64 `json:"p50_error"`
+	P99Error float64 `json:"p99_error"`
+	MaxError float64 `json:"max_error"`
+}
+
+// DriftThresholds are the errors at which a DriftMonitor's hook fires. A zero
+// value disables that threshold.
+type DriftThresholds struct {
+	// MeanError is compared with the absolute value of the mean error.
+	MeanError float64 `json:"mean_error,omitempty"`
+	P99Error  float64 `json:"p99_error,omitempty"`
+	// MinSamples is how many samples a key needs before its thresholds are
+	// checked, so a single odd request doesn't fire the hook.
+	MinSamples int `json:"min_samples,omitempty"`
+	// Window is how many of the most recent samples are kept for each key.
+	// It defaults to 1000, so a format change isn't diluted by history.
+	Window int `json:"window,omitempty"`
+}
+
+const defaultDriftWindow = 1000
+
+// DriftEvent is passed to the drift hook when a key's error crosses a
+// threshold.
+type DriftEvent struct {
+	Key   DriftKey
+	Stats DriftStats
+	// Metric is "mean" or "p99".
+	Metric    string
+	Threshold float64
+}
+
+// DriftMonitor compares prompt token estimates with the usage OpenAI reports,
+// to catch changes to the hidden prompt format from production traffic. It's
+// safe for concurrent use.
+type DriftMonitor struct {
+	mu         sync.Mutex
+	thresholds DriftThresholds
+	onDrift    func(DriftEvent)
+	samples    map[DriftKey]*driftSamples
+}
+
+// driftSamples is a ring buffer of a key's most recent relative errors, and
+// which thresholds they're above.
+type driftSamples struct {
+	errors []float64
+	next   int
+	over   map[string]bool
+}
+
+// NewDriftMonitor creates a drift monitor. If onDrift is not nil it's called,
+// outside of any lock, whenever a key's error rises above a threshold. It
+// fires again only after the error has fallen back below the threshold.
+func NewDriftMonitor(thresholds DriftThresholds, onDrift func(DriftEvent)) *DriftMonitor {
+	if thresholds.Window <= 0 {
+		thresholds.Window = defaultDriftWindow
+	}
+	return &DriftMonitor{
+		thresholds: thresholds,
+		onDrift:    onDrift,
+		samples:    make(map[DriftKey]*driftSamples),
+	}
+}
+
+// Observe records the prompt token estimate for a request, such as from
+// CountRequestTokens, against the usage OpenAI reported for it. The sample is
+// tracked for the request's model, both overall and for each feature it uses.
+// Usage without prompt tokens, as from a failed call, is ignored.
+func (m *DriftMonitor) Observe(
+	req openai.ChatCompletionRequest,
+	estimate int,
+	usage openai.Usage,
+) {
+	if usage.PromptTokens <= 0 {
+		return
+	}
+	relative := float64(estimate-usage.PromptTokens) / float64(usage.PromptTokens)
+
+	var events []DriftEvent
+	m.mu.Lock()
+	for _, feature := range driftFeatures(req) {
+		events = append(events, m.observe(DriftKey{Model: req.Model, Feature: feature}, relative)...)
+	}
+	m.mu.Unlock()
+
+	if m.onDrift != nil {
+		for _, e := range events {
+			m.onDrift(e)
+		}
+	}
+}
+
+func (m *DriftMonitor) observe(key DriftKey, relative float64) []DriftEvent {
+	s, ok := m.samples[key]
+	if !ok {
+		s = &driftSamples{over: make(map[string]bool)}
+		m.samples[key] = s
+	}
+	if len(s.errors) < m.thresholds.Window {
+		s.errors = append(s.errors, relative)
+	} else {
+		s.errors[s.next] = relative
+		s.next = (s.next + 1) % len(s.errors)
+	}
+
+	if len(s.errors) < m.thresholds.MinSamples {
+		return nil
+	}
+	stats := newDriftStats(s.errors)
+
+	var events []DriftEvent
+	check := func(metric string, value, threshold float64) {
+		if threshold <= 0 {
+			return
+		}
+		over := value > threshold
+		if over && !s.over[metric] {
+			events = append(events, DriftEvent{Key: key, Stats: stats, Metric: metric, Threshold: threshold})
+		}
+		s.over[metric] = over
+	}
+	check("mean", math.Abs(stats.MeanError), m.thresholds.MeanError)
+	check("p99", stats.P99Error, m.thresholds.P99Error)
+
+	return events
+}
+
+// Stats returns the current error distribution of every key with samples.
+func (m *DriftMonitor) Stats() map[DriftKey]DriftStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stats := make(map[DriftKey]DriftStats, len(m.samples))
+	for key, s := range m.samples {
+		stats[key] = newDriftStats(s.errors)
+	}
+	return stats
+}
+
+func newDriftStats(errors []float64) DriftStats {
+	if len(errors) == 0 {
+		return DriftStats{}
+	}
+
+	var sum float64
+	abs := make([]float64, len(errors))
+	for i, e := range errors {
+		sum += e
+		abs[i] = math.Abs(e)
+	}
+	sort.Float64s(abs)
+	// Nearest rank, so the p99 of a small window is its largest error. The
+	// epsilon keeps 0.99*100 from rounding up to the maximum.
+	percentile := func(p float64) float64 {
+		return abs[int(math.Ceil(p*float64(len(abs))-1e-9))-1]
+	}
+
+	return DriftStats{
+		Samples:   len(errors),
+		MeanError: sum / float64(len(errors)),
+		P50Error:  percentile(0.5),
+		P99Error:  percentile(0.99),
+		MaxError:  abs[len(abs)-1],
+	}
+}
+
+// driftFeatures returns DriftAll and the features a request uses.
+func driftFeatures(req openai.ChatCompletionRequest) []DriftFeature {
+	features := []DriftFeature{DriftAll}
+	if len(req.Tools) > 0 || len(req.Functions) > 0 {
+		features = append(features, DriftTools)
+	}
+
+	var toolMessages, images bool
+	for _, m := range req.Messages {
+		if m.Role == openai.ChatMessageRoleTool || m.Role == openai.ChatMessageRoleFunction {
+			toolMessages = true
+		}
+		for _, p := range m.MultiContent {
+			if p.Type == openai.ChatMessagePartTypeImageURL {
+				images = true
+			}
+		}
+	}
+	if toolMessages {
+		features = append(features, DriftToolMessages)
+	}
+	if images {
+		features = append(features, DriftImages)
+	}
+
+	return features
+}
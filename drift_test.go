@@ -0,0 +1,76 @@
+package tokens
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+func TestDriftMonitor(t *testing.T) {
+	var events []DriftEvent
+	m := NewDriftMonitor(DriftThresholds{MeanError: 0.05, P99Error: 0.2, MinSamples: 3, Window: 4}, func(e DriftEvent) {
+		events = append(events, e)
+	})
+
+	plain := openai.ChatCompletionRequest{
+		Model:    openai.GPT4o,
+		Messages: []openai.ChatCompletionMessage{{Role: openai.ChatMessageRoleUser, Content: "Hi"}},
+	}
+	withTools := plain
+	withTools.Tools = skiWeatherTools
+	withTools.Messages = append(withTools.Messages, openai.ChatCompletionMessage{
+		Role:       openai.ChatMessageRoleTool,
+		Content:    "{}",
+		ToolCallID: "call_1",
+	})
+
+	reported := func(prompt int) openai.Usage {
+		return openai.Usage{PromptTokens: prompt}
+	}
+
+	for i := 0; i < 3; i++ {
+		m.Observe(plain, 100, reported(100))
+	}
+	m.Observe(withTools, 100, reported(0))
+	if len(events) != 0 {
+		t.Fatalf("exact estimates: got events %+v", events)
+	}
+
+	// The tool format changes, and tool requests are now undercounted by 10%.
+	for i := 0; i < 3; i++ {
+		m.Observe(withTools, 90, reported(100))
+	}
+	var got []DriftKey
+	for _, e := range events {
+		if e.Metric != "mean" {
+			t.Errorf("got a %s event, want only mean", e.Metric)
+		}
+		got = append(got, e.Key)
+	}
+	want := []DriftKey{
+		{openai.GPT4o, DriftAll},
+		{openai.GPT4o, DriftTools},
+		{openai.GPT4o, DriftToolMessages},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got events for %v, want %v", got, want)
+	}
+
+	stats := m.Stats()
+	if s := stats[DriftKey{openai.GPT4o, DriftTools}]; s.Samples != 3 || s.MeanError > -0.099 || s.MeanError < -0.101 {
+		t.Errorf("tools stats: got %+v", s)
+	}
+	// The window keeps the 4 most recent samples.
+	if s := stats[DriftKey{openai.GPT4o, DriftAll}]; s.Samples != 4 {
+		t.Errorf("all stats: got %+v, want 4 samples", s)
+	}
+
+	// A large overcount crosses the p99 threshold, and cancels out enough of
+	// the undercount that the mean doesn't.
+	events = nil
+	m.Observe(withTools, 150, reported(100))
+	if len(events) != 3 || events[0].Metric != "p99" {
+		t.Errorf("outlier: got %+v, want 3 p99 events", events)
+	}
+}
@@ -0,0 +1,240 @@
+package tokens
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+// Embeddings request limits.
+const (
+	// EmbeddingMaxInputTokens is the most tokens a single input may have.
+	EmbeddingMaxInputTokens = 8191
+	// EmbeddingMaxRequestTokens is the most tokens, summed across inputs, a
+	// single request may have.
+	EmbeddingMaxRequestTokens = 300000
+	// EmbeddingMaxInputs is the most inputs a single request may have.
+	EmbeddingMaxInputs = 2048
+)
+
+// CountEmbeddingRequestTokens returns the number of tokens in an embeddings
+// request. Embeddings have no per-request overhead, so this is the sum of the
+// tokens in each input.
+func (c *Counter) CountEmbeddingRequestTokens(
+	req openai.EmbeddingRequestConverter,
+) (int, error) {
+	counts, err := c.CountEmbeddingInputs(req.Convert().Input)
+	if err != nil {
+		return 0, err
+	}
+
+	var count int
+	for _, n := range counts {
+		count += n
+	}
+
+	return count, nil
+}
+
+// CountEmbeddingInputs returns the token count of each input of an
+// embeddings request. Input may be a string, an array of strings, an array of
+// token IDs or an array of token ID arrays, either as Go types or as decoded
+// from JSON.
+func (c *Counter) CountEmbeddingInputs(input any) ([]int, error) {
+	switch in := input.(type) {
+	case string:
+		return []int{c.CountTokens(in)}, nil
+	case []string:
+		counts := make([]int, len(in))
+		for i, s := range in {
+			counts[i] = c.CountTokens(s)
+		}
+		return counts, nil
+	case []int:
+		return []int{len(in)}, nil
+	case [][]int:
+		counts := make([]int, len(in))
+		for i, ids := range in {
+			counts[i] = len(ids)
+		}
+		return counts, nil
+	case []any:
+		if len(in) == 0 {
+			return nil, errors.New("empty input")
+		}
+		if _, ok := in[0].(float64); ok {
+			// A single array of token IDs, as decoded from JSON.
+			return []int{len(in)}, nil
+		}
+		counts := make([]int, len(in))
+		for i, el := range in {
+			switch el := el.(type) {
+			case string:
+				counts[i] = c.CountTokens(el)
+			case []any:
+				counts[i] = len(el)
+			default:
+				return nil, fmt.Errorf("unsupported input element %T", el)
+			}
+		}
+		return counts, nil
+	default:
+		return nil, fmt.Errorf("unsupported input %T", input)
+	}
+}
+
+// OversizePolicy decides what an EmbeddingBatcher does with an input that has
+// more tokens than the per-input limit.
+type OversizePolicy int
+
+const (
+	// OversizeError fails the batch.
+	OversizeError OversizePolicy = iota
+	// OversizeTruncate keeps the input's leading tokens.
+	OversizeTruncate
+	// OversizeSplit splits the input into several inputs, each embedded
+	// separately.
+	OversizeSplit
+)
+
+// OversizeInputError is returned by an EmbeddingBatcher using OversizeError.
+type OversizeInputError struct {
+	Index  int
+	Tokens int
+	Limit  int
+}
+
+func (e *OversizeInputError) Error() string {
+	return fmt.Sprintf("input %d has %d tokens, more than the limit of %d", e.Index, e.Tokens, e.Limit)
+}
+
+// EmbeddingBatch is a single embeddings request built by an EmbeddingBatcher.
+type EmbeddingBatch struct {
+	Request openai.EmbeddingRequest
+	// Sources holds, for each input in the request, the index of the text it
+	// came from. A split text has several inputs with the same source.
+	Sources []int
+	Tokens  int
+}
+
+// EmbeddingBatcher packs texts into as few embeddings requests as the limits
+// allow. The limits default to OpenAI's and may be lowered.
+type EmbeddingBatcher struct {
+	MaxInputTokens   int
+	MaxRequestTokens int
+	MaxInputs        int
+	Oversize         OversizePolicy
+
+	counter *Counter
+}
+
+// NewEmbeddingBatcher creates a batcher for the counter's model.
+func NewEmbeddingBatcher(c *Counter, oversize OversizePolicy) *EmbeddingBatcher {
+	return &EmbeddingBatcher{
+		MaxInputTokens:   EmbeddingMaxInputTokens,
+		MaxRequestTokens: EmbeddingMaxRequestTokens,
+		MaxInputs:        EmbeddingMaxInputs,
+		Oversize:         oversize,
+		counter:          c,
+	}
+}
+
+// Batch returns the requests needed to embed texts, in order.
+func (b *EmbeddingBatcher) Batch(texts []string) ([]EmbeddingBatch, error) {
+	var (
+		batches []EmbeddingBatch
+		current EmbeddingBatch
+	)
+	flush := func() {
+		if len(current.Sources) > 0 {
+			batches = append(batches, current)
+		}
+		current = EmbeddingBatch{}
+	}
+
+	for i, text := range texts {
+		inputs, counts, err := b.fit(i, text)
+		if err != nil {
+			return nil, err
+		}
+
+		for j, input := range inputs {
+			n := counts[j]
+			if len(current.Sources) == b.MaxInputs || current.Tokens+n > b.MaxRequestTokens {
+				flush()
+			}
+			if len(current.Sources) == 0 {
+				current.Request = openai.EmbeddingRequest{
+					Model: openai.EmbeddingModel(b.counter.model),
+					Input: []string{},
+				}
+			}
+			current.Request.Input = append(current.Request.Input.([]string), input)
+			current.Sources = append(current.Sources, i)
+			current.Tokens += n
+		}
+	}
+	flush()
+
+	return batches, nil
+}
+
+// fit applies the oversize policy to a text, returning the inputs it becomes
+// and their token counts.
+func (b *EmbeddingBatcher) fit(index int, text string) ([]string, []int, error) {
+	limit := b.MaxInputTokens
+	if b.MaxRequestTokens < limit {
+		limit = b.MaxRequestTokens
+	}
+
+	n := b.counter.CountTokens(text)
+	if n <= limit {
+		return []string{text}, []int{n}, nil
+	}
+
+	switch b.Oversize {
+	case OversizeTruncate, OversizeSplit:
+	default:
+		return nil, nil, &OversizeInputError{Index: index, Tokens: n, Limit: limit}
+	}
+
+	var (
+		ids    = b.counter.tokenizer.Encode(text)
+		inputs []string
+		counts []int
+	)
+	for len(ids) > 0 {
+		chunk, size := b.decodeChunk(ids, limit)
+		inputs = append(inputs, chunk)
+		counts = append(counts, b.counter.CountTokens(chunk))
+		ids = ids[size:]
+
+		if b.Oversize == OversizeTruncate {
+			break
+		}
+	}
+
+	return inputs, counts, nil
+}
+
+// decodeChunk decodes the longest prefix of ids that re-encodes within limit.
+// Decoding can split a multi-byte character, which re-encodes as more tokens
+// than it started as, so the prefix is shrunk until it fits.
+func (b *EmbeddingBatcher) decodeChunk(ids []int, limit int) (string, int) {
+	size := limit
+	if size > len(ids) {
+		size = len(ids)
+	}
+	for {
+		chunk := b.counter.tokenizer.Decode(ids[:size])
+		n := b.counter.CountTokens(chunk)
+		if n <= limit || size == 1 {
+			return chunk, size
+		}
+		size -= n - limit
+		if size < 1 {
+			size = 1
+		}
+	}
+}
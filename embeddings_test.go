@@ -0,0 +1,103 @@
+package tokens
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+func TestCountEmbeddingRequestTokensPreTokenized(t *testing.T) {
+	tests := []struct {
+		name string
+		in   openai.EmbeddingRequestConverter
+		want int
+	}{{
+		name: "Token arrays",
+		in: openai.EmbeddingRequestTokens{
+			Model: openai.SmallEmbedding3,
+			Input: [][]int{{1, 2, 3}, {4, 5}},
+		},
+		want: 5,
+	}, {
+		name: "Single token array",
+		in: openai.EmbeddingRequest{
+			Model: openai.SmallEmbedding3,
+			Input: []int{1, 2, 3, 4},
+		},
+		want: 4,
+	}, {
+		name: "Token arrays decoded from JSON",
+		in: openai.EmbeddingRequest{
+			Model: openai.SmallEmbedding3,
+			Input: []any{[]any{1.0, 2.0}, []any{3.0}},
+		},
+		want: 3,
+	}}
+
+	// Pre-tokenized inputs don't need a tokenizer.
+	c := &Counter{model: string(openai.SmallEmbedding3)}
+	for _, tt := range tests {
+		got, err := c.CountEmbeddingRequestTokens(tt.in)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s: got %d, want %d", tt.name, got, tt.want)
+		}
+	}
+
+	if _, err := c.CountEmbeddingRequestTokens(openai.EmbeddingRequest{Input: 42}); err == nil {
+		t.Errorf("unsupported input: got nil error")
+	}
+}
+
+func TestEmbeddingBatcher(t *testing.T) {
+	c := newTestCounter(t, string(openai.SmallEmbedding3))
+
+	b := NewEmbeddingBatcher(c, OversizeSplit)
+	b.MaxInputTokens = 10
+	b.MaxRequestTokens = 25
+	b.MaxInputs = 3
+
+	texts := []string{
+		"short",                 // 5
+		strings.Repeat("a", 23), // split into 10, 10, 3
+		"tiny",                  // 4
+		strings.Repeat("b", 10), // 10
+	}
+	batches, err := b.Batch(texts)
+	if err != nil {
+		t.Fatalf("Batch: %v", err)
+	}
+
+	var (
+		gotSources [][]int
+		gotTokens  []int
+	)
+	for _, batch := range batches {
+		gotSources = append(gotSources, batch.Sources)
+		gotTokens = append(gotTokens, batch.Tokens)
+	}
+	wantSources := [][]int{{0, 1, 1}, {1, 2, 3}}
+	wantTokens := []int{25, 17}
+	if !reflect.DeepEqual(gotSources, wantSources) || !reflect.DeepEqual(gotTokens, wantTokens) {
+		t.Errorf("got sources %v with %v tokens, want %v with %v", gotSources, gotTokens, wantSources, wantTokens)
+	}
+
+	b.Oversize = OversizeTruncate
+	batches, err = b.Batch([]string{strings.Repeat("a", 23)})
+	if err != nil {
+		t.Fatalf("Batch truncating: %v", err)
+	}
+	if input := batches[0].Request.Input.([]string); len(input) != 1 || input[0] != strings.Repeat("a", 10) {
+		t.Errorf("truncated: got %q", input)
+	}
+
+	b.Oversize = OversizeError
+	if _, err := b.Batch([]string{strings.Repeat("a", 23)}); err == nil {
+		t.Errorf("oversize error: got nil")
+	}
+}
@@ -0,0 +1,311 @@
+package tokens
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+// TrainingContextWindows maps fine-tunable models to the most tokens a single
+// training example may contain. Longer examples are truncated.
+var TrainingContextWindows = map[string]int{
+	"gpt-4o":        65536,
+	"gpt-4o-mini":   65536,
+	"gpt-3.5-turbo": 16385,
+}
+
+// TrainingPrices maps fine-tunable models to their training price in US
+// dollars per million tokens.
+var TrainingPrices = map[string]float64{
+	"gpt-4o":        25.00,
+	"gpt-4o-mini":   3.00,
+	"gpt-3.5-turbo": 8.00,
+}
+
+// The default number of epochs targets 3 passes over the data, adjusted so
+// that small and large datasets see a sensible number of examples.
+const (
+	defaultEpochs     = 3
+	minTargetExamples = 100
+	maxTargetExamples = 25000
+	minDefaultEpochs  = 1
+	maxDefaultEpochs  = 25
+)
+
+// TrainingExample is a single line of a chat fine-tuning file.
+type TrainingExample struct {
+	Messages []TrainingMessage `json:"messages"`
+	Tools    []openai.Tool     `json:"tools,omitempty"`
+}
+
+// TrainingMessage is a chat message with an optional training weight. A
+// weight of 0 excludes an assistant message from training.
+type TrainingMessage struct {
+	openai.ChatCompletionMessage
+	Weight *int
+}
+
+// UnmarshalJSON decodes the message and its weight. ChatCompletionMessage has
+// its own UnmarshalJSON, which would otherwise hide the weight.
+func (m *TrainingMessage) UnmarshalJSON(b []byte) error {
+	if err := json.Unmarshal(b, &m.ChatCompletionMessage); err != nil {
+		return err
+	}
+	var weight struct {
+		Weight *int `json:"weight"`
+	}
+	if err := json.Unmarshal(b, &weight); err != nil {
+		return err
+	}
+	m.Weight = weight.Weight
+	return nil
+}
+
+// FineTuneIssue is a format error in a training example.
+type FineTuneIssue struct {
+	Line    int    `json:"line"`
+	Problem string `json:"problem"`
+}
+
+// Distribution summarizes a set of token counts.
+type Distribution struct {
+	Min    int     `json:"min"`
+	Max    int     `json:"max"`
+	Mean   float64 `json:"mean"`
+	Median int     `json:"median"`
+	P5     int     `json:"p5"`
+	P95    int     `json:"p95"`
+}
+
+func newDistribution(values []int) Distribution {
+	if len(values) == 0 {
+		return Distribution{}
+	}
+	sorted := append([]int(nil), values...)
+	sort.Ints(sorted)
+
+	var sum int
+	for _, v := range sorted {
+		sum += v
+	}
+	percentile := func(p float64) int {
+		return sorted[int(p*float64(len(sorted)-1))]
+	}
+
+	return Distribution{
+		Min:    sorted[0],
+		Max:    sorted[len(sorted)-1],
+		Mean:   float64(sum) / float64(len(sorted)),
+		Median: percentile(0.5),
+		P5:     percentile(0.05),
+		P95:    percentile(0.95),
+	}
+}
+
+// FineTuneReport summarizes a chat fine-tuning file.
+type FineTuneReport struct {
+	Examples int `json:"examples"`
+	// Invalid examples have at least one issue and are not counted.
+	Invalid int             `json:"invalid"`
+	Issues  []FineTuneIssue `json:"issues,omitempty"`
+	// TooLong examples exceed the model's training context and will be
+	// truncated.
+	TooLong         int          `json:"too_long"`
+	Tokens          Distribution `json:"tokens"`
+	AssistantTokens Distribution `json:"assistant_tokens"`
+	// BilledTokensPerEpoch counts each example up to the training context.
+	BilledTokensPerEpoch int     `json:"billed_tokens_per_epoch"`
+	Epochs               int     `json:"epochs"`
+	BilledTokens         int     `json:"billed_tokens"`
+	Cost                 float64 `json:"cost"`
+	Priced               bool    `json:"priced"`
+}
+
+// ValidateFineTuning reads a chat fine-tuning file, one TrainingExample per
+// line, reporting format errors and counting valid examples the same way as
+// CountRequestTokens. If epochs is 0 the number OpenAI would choose by
+// default is used.
+func (c *Counter) ValidateFineTuning(r io.Reader, epochs int) (*FineTuneReport, error) {
+	var (
+		report    = &FineTuneReport{}
+		counts    []int
+		assistant []int
+		window, _ = lookupModel(TrainingContextWindows, c.model)
+	)
+
+	br := bufio.NewReader(r)
+	for lineNo := 1; ; lineNo++ {
+		line, err := br.ReadBytes('\n')
+		if len(bytes.TrimSpace(line)) > 0 {
+			report.Examples++
+
+			issues := validateTrainingExample(line)
+			for _, problem := range issues {
+				report.Issues = append(report.Issues, FineTuneIssue{
+					Line:    lineNo,
+					Problem: problem,
+				})
+			}
+			if len(issues) > 0 {
+				report.Invalid++
+			} else {
+				var ex TrainingExample
+				json.Unmarshal(line, &ex)
+
+				total, trained := c.countTrainingExample(ex)
+				counts = append(counts, total)
+				assistant = append(assistant, trained)
+				if window > 0 && total > window {
+					report.TooLong++
+					total = window
+				}
+				report.BilledTokensPerEpoch += total
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	report.Tokens = newDistribution(counts)
+	report.AssistantTokens = newDistribution(assistant)
+
+	report.Epochs = epochs
+	if report.Epochs == 0 {
+		report.Epochs = DefaultEpochs(len(counts))
+	}
+	report.BilledTokens = report.BilledTokensPerEpoch * report.Epochs
+	if price, ok := lookupModel(TrainingPrices, c.model); ok {
+		report.Cost = float64(report.BilledTokens) * price / 1e6
+		report.Priced = true
+	}
+
+	return report, nil
+}
+
+// DefaultEpochs returns the number of epochs OpenAI trains for when none is
+// specified.
+func DefaultEpochs(examples int) int {
+	switch {
+	case examples == 0:
+		return defaultEpochs
+	case examples*defaultEpochs < minTargetExamples:
+		epochs := minTargetExamples / examples
+		if epochs > maxDefaultEpochs {
+			epochs = maxDefaultEpochs
+		}
+		return epochs
+	case examples*defaultEpochs > maxTargetExamples:
+		epochs := maxTargetExamples / examples
+		if epochs < minDefaultEpochs {
+			epochs = minDefaultEpochs
+		}
+		return epochs
+	default:
+		return defaultEpochs
+	}
+}
+
+// countTrainingExample returns the tokens in the example and in the assistant
+// messages that will be trained on.
+func (c *Counter) countTrainingExample(ex TrainingExample) (total, trained int) {
+	req := openai.ChatCompletionRequest{
+		Tools: ex.Tools,
+	}
+	for _, m := range ex.Messages {
+		req.Messages = append(req.Messages, m.ChatCompletionMessage)
+		if m.Role == openai.ChatMessageRoleAssistant && (m.Weight == nil || *m.Weight != 0) {
+			trained += c.CountMessageTokens(m.ChatCompletionMessage)
+		}
+	}
+	return c.CountRequestTokens(req), trained
+}
+
+var trainingRoles = map[string]bool{
+	openai.ChatMessageRoleSystem:    true,
+	openai.ChatMessageRoleUser:      true,
+	openai.ChatMessageRoleAssistant: true,
+	openai.ChatMessageRoleTool:      true,
+	openai.ChatMessageRoleFunction:  true,
+}
+
+// validateTrainingExample returns the format problems with a single line of a
+// fine-tuning file.
+func validateTrainingExample(line []byte) []string {
+	var ex TrainingExample
+	if err := json.Unmarshal(line, &ex); err != nil {
+		return []string{fmt.Sprintf("invalid JSON: %v", err)}
+	}
+	if len(ex.Messages) == 0 {
+		return []string{"missing messages"}
+	}
+
+	var (
+		problems     []string
+		hasAssistant bool
+		tools        = make(map[string]bool)
+		calls        = make(map[string]bool)
+	)
+	for _, t := range ex.Tools {
+		if t.Function != nil {
+			tools[t.Function.Name] = true
+		}
+	}
+
+	for i, m := range ex.Messages {
+		if !trainingRoles[m.Role] {
+			problems = append(problems, fmt.Sprintf("message %d: unknown role %q", i, m.Role))
+			continue
+		}
+
+		hasContent := m.Content != "" || len(m.MultiContent) > 0
+		if !hasContent && len(m.ToolCalls) == 0 && m.FunctionCall == nil {
+			problems = append(problems, fmt.Sprintf("message %d: missing content", i))
+		}
+
+		if m.Weight != nil {
+			if *m.Weight != 0 && *m.Weight != 1 {
+				problems = append(problems, fmt.Sprintf("message %d: weight must be 0 or 1", i))
+			}
+			if m.Role != openai.ChatMessageRoleAssistant {
+				problems = append(problems, fmt.Sprintf("message %d: weight is only allowed on assistant messages", i))
+			}
+		}
+
+		switch m.Role {
+		case openai.ChatMessageRoleAssistant:
+			hasAssistant = true
+			for _, tc := range m.ToolCalls {
+				if tc.ID == "" {
+					problems = append(problems, fmt.Sprintf("message %d: tool call without an id", i))
+				}
+				calls[tc.ID] = true
+				if len(ex.Tools) > 0 && !tools[tc.Function.Name] {
+					problems = append(problems, fmt.Sprintf("message %d: call to undefined tool %q", i, tc.Function.Name))
+				}
+				if !json.Valid([]byte(tc.Function.Arguments)) {
+					problems = append(problems, fmt.Sprintf("message %d: tool call %q arguments are not valid JSON", i, tc.ID))
+				}
+			}
+		case openai.ChatMessageRoleTool:
+			if !calls[m.ToolCallID] {
+				problems = append(problems, fmt.Sprintf("message %d: tool_call_id %q doesn't match an earlier tool call", i, m.ToolCallID))
+			}
+		}
+	}
+
+	if !hasAssistant {
+		problems = append(problems, "missing assistant message")
+	}
+
+	return problems
+}
@@ -0,0 +1,95 @@
+package tokens
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateTrainingExample(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want []string
+	}{{
+		name: "Valid",
+		in:   `{"messages":[{"role":"user","content":"Hi"},{"role":"assistant","content":"Hello","weight":0}]}`,
+	}, {
+		name: "Missing assistant",
+		in:   `{"messages":[{"role":"system","content":"Be nice."},{"role":"user","content":"Hi"}]}`,
+		want: []string{"missing assistant message"},
+	}, {
+		name: "Unknown role",
+		in:   `{"messages":[{"role":"robot","content":"Beep"},{"role":"assistant","content":"Boop"}]}`,
+		want: []string{`message 0: unknown role "robot"`},
+	}, {
+		name: "Bad weight",
+		in:   `{"messages":[{"role":"user","content":"Hi","weight":1},{"role":"assistant","content":"Hello","weight":2}]}`,
+		want: []string{
+			"message 0: weight is only allowed on assistant messages",
+			"message 1: weight must be 0 or 1",
+		},
+	}, {
+		name: "Bad tool call references",
+		in: `{"messages":[` +
+			`{"role":"user","content":"Weather in Vail?"},` +
+			`{"role":"assistant","tool_calls":[{"id":"call_1","type":"function","function":{"name":"get_snow","arguments":"{"}}]},` +
+			`{"role":"tool","tool_call_id":"call_2","content":"Sunny"},` +
+			`{"role":"assistant","content":"It's sunny."}],` +
+			`"tools":[{"type":"function","function":{"name":"get_current_weather"}}]}`,
+		want: []string{
+			`message 1: call to undefined tool "get_snow"`,
+			`message 1: tool call "call_1" arguments are not valid JSON`,
+			`message 2: tool_call_id "call_2" doesn't match an earlier tool call`,
+		},
+	}, {
+		name: "No messages",
+		in:   `{"prompt":"Hi","completion":"Hello"}`,
+		want: []string{"missing messages"},
+	}}
+
+	for _, tt := range tests {
+		got := validateTrainingExample([]byte(tt.in))
+		if strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestValidateFineTuningInvalid(t *testing.T) {
+	file := strings.Join([]string{
+		`{"messages":[{"role":"user","content":"Hi"}]}`,
+		`{"messages":[]}`,
+		`{`,
+	}, "\n")
+
+	// Invalid examples aren't counted, so no tokenizer is needed.
+	c := &Counter{model: "gpt-4o-mini"}
+	report, err := c.ValidateFineTuning(strings.NewReader(file), 0)
+	if err != nil {
+		t.Fatalf("ValidateFineTuning: %v", err)
+	}
+	if report.Examples != 3 || report.Invalid != 3 || len(report.Issues) != 3 {
+		t.Errorf("got %+v, want 3 invalid examples with 3 issues", report)
+	}
+	if report.BilledTokens != 0 || report.Cost != 0 {
+		t.Errorf("got %d billed tokens costing %v, want 0", report.BilledTokens, report.Cost)
+	}
+}
+
+func TestDefaultEpochs(t *testing.T) {
+	tests := []struct {
+		examples int
+		want     int
+	}{
+		{examples: 10, want: 10},
+		{examples: 2, want: 25},
+		{examples: 1000, want: 3},
+		{examples: 10000, want: 2},
+		{examples: 50000, want: 1},
+	}
+	for _, tt := range tests {
+		if got := DefaultEpochs(tt.examples); got != tt.want {
+			t.Errorf("DefaultEpochs(%d): got %d, want %d", tt.examples, got, tt.want)
+		}
+	}
+}
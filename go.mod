@@ -2,9 +2,12 @@ module github.com/chrisdinn/tokens
 
 go 1.20
 
+require (
+	github.com/pkoukk/tiktoken-go v0.1.7
+	github.com/sashabaranov/go-openai v1.26.0
+)
+
 require (
 	github.com/dlclark/regexp2 v1.10.0 // indirect
 	github.com/google/uuid v1.3.0 // indirect
-	github.com/pkoukk/tiktoken-go v0.1.7 // indirect
-	github.com/sashabaranov/go-openai v1.26.0 // indirect
 )
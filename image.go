@@ -0,0 +1,95 @@
+package tokens
+
+import (
+	"bytes"
+	"encoding/base64"
+	"image"
+	"math"
+	"strings"
+
+	// Register decoders for reading image dimensions.
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+)
+
+// ImageTokenCost is what an image input costs for a model: a base amount,
+// which is all a low detail image costs, plus an amount per 512px tile of a
+// high detail image.
+type ImageTokenCost struct {
+	Base int
+	Tile int
+}
+
+// ImageTokenCosts are the image input costs of models that don't use the
+// default of 85 base and 170 per tile.
+var ImageTokenCosts = map[string]ImageTokenCost{
+	"gpt-4o-mini": {Base: 2833, Tile: 5667},
+}
+
+var defaultImageTokenCost = ImageTokenCost{Base: 85, Tile: 170}
+
+// High detail images are scaled to fit in imageMaxEdge square, then so their
+// short edge is at most imageShortEdge, and are cut into imageTileSize tiles.
+const (
+	imageMaxEdge   = 2048
+	imageShortEdge = 768
+	imageTileSize  = 512
+	// imageMaxTiles is the most tiles a scaled image can have, 4 by 2.
+	imageMaxTiles = 8
+)
+
+func imageTokenCost(model string) ImageTokenCost {
+	if cost, ok := lookupModel(ImageTokenCosts, model); ok {
+		return cost
+	}
+	return defaultImageTokenCost
+}
+
+// imageTiles returns the number of tiles a high detail image of the given
+// size is cut into.
+func imageTiles(width, height int) int {
+	w, h := float64(width), float64(height)
+	if long := math.Max(w, h); long > imageMaxEdge {
+		w, h = w*imageMaxEdge/long, h*imageMaxEdge/long
+	}
+	if short := math.Min(w, h); short > imageShortEdge {
+		w, h = w*imageShortEdge/short, h*imageShortEdge/short
+	}
+	return int(math.Ceil(w/imageTileSize) * math.Ceil(h/imageTileSize))
+}
+
+// imageTokens returns the tokens of an image part. Only images given as data
+// URLs can be measured; others are assumed to be the largest size.
+func (c *Counter) imageTokens(url, detail string) int {
+	cost := imageTokenCost(c.model)
+	if detail == "low" {
+		return cost.Base
+	}
+
+	tiles := imageMaxTiles
+	if cfg, ok := imageConfig(url); ok {
+		tiles = imageTiles(cfg.Width, cfg.Height)
+	}
+	return cost.Base + cost.Tile*tiles
+}
+
+// imageConfig decodes the dimensions of an image in a base64 data URL.
+func imageConfig(url string) (image.Config, bool) {
+	if !strings.HasPrefix(url, "data:") {
+		return image.Config{}, false
+	}
+	header, data, ok := strings.Cut(url, ",")
+	if !ok || !strings.HasSuffix(header, ";base64") {
+		return image.Config{}, false
+	}
+	b, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return image.Config{}, false
+	}
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(b))
+	if err != nil {
+		return image.Config{}, false
+	}
+	return cfg, true
+}
@@ -0,0 +1,208 @@
+package tokens
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"math"
+)
+
+// ImageOptions says how OptimizeImage may change an image.
+type ImageOptions struct {
+	// Detail is the detail level the image will be sent at: "low", "high"
+	// or "auto", which is billed as high.
+	Detail string
+	// MaxTiles limits a high detail image to this many tiles. Zero only
+	// shrinks images to the size OpenAI would scale them to.
+	MaxTiles int
+	// Crop fits MaxTiles by cropping the image around its center to a tile
+	// boundary, keeping its resolution, rather than by scaling it down.
+	Crop bool
+}
+
+// OptimizedImage is an image prepared for sending by OptimizeImage.
+type OptimizedImage struct {
+	// DataURL is the image to send, as a base64 data URL.
+	DataURL string
+	// Width and Height are the size of the image in DataURL.
+	Width  int
+	Height int
+	// Tiles and tokens the image was billed for before and after.
+	TilesBefore  int
+	TilesAfter   int
+	TokensBefore int
+	TokensAfter  int
+}
+
+// OptimizeImage prepares a PNG, JPEG or GIF image for the counter's model,
+// reporting the tokens it costs before and after. Images are never larger
+// than OpenAI would scale them to, so bytes aren't sent only to be thrown
+// away: low detail images fit in one tile, and high detail images in
+// OpenAI's limits and opts.MaxTiles. Images that need no change are sent as
+// they are; others are re-encoded, as JPEG if they were JPEG and as PNG
+// otherwise.
+func (c *Counter) OptimizeImage(data []byte, opts ImageOptions) (OptimizedImage, error) {
+	img, format, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return OptimizedImage{}, fmt.Errorf("decoding image: %w", err)
+	}
+
+	var (
+		cost   = imageTokenCost(c.model)
+		bounds = img.Bounds()
+		result = OptimizedImage{Width: bounds.Dx(), Height: bounds.Dy()}
+		rect   = bounds
+	)
+
+	if opts.Detail == "low" {
+		result.TokensBefore, result.TokensAfter = cost.Base, cost.Base
+		result.Width, result.Height = fitImage(bounds.Dx(), bounds.Dy(), imageTileSize, imageTileSize)
+	} else {
+		result.TilesBefore = imageTiles(bounds.Dx(), bounds.Dy())
+		result.TokensBefore = cost.Base + cost.Tile*result.TilesBefore
+
+		w, h := scaledImageSize(bounds.Dx(), bounds.Dy())
+		if opts.MaxTiles > 0 && imageTiles(w, h) > opts.MaxTiles {
+			tx, ty := bestTileGrid(w, h, opts.MaxTiles, opts.Crop)
+			if opts.Crop {
+				rect = cropRect(bounds, w, h, tx, ty)
+				w, h = intMin(w, tx*imageTileSize), intMin(h, ty*imageTileSize)
+			} else {
+				w, h = fitImage(w, h, tx*imageTileSize, ty*imageTileSize)
+			}
+		}
+		result.Width, result.Height = w, h
+		result.TilesAfter = imageTiles(w, h)
+		result.TokensAfter = cost.Base + cost.Tile*result.TilesAfter
+	}
+
+	if rect == bounds && result.Width == bounds.Dx() && result.Height == bounds.Dy() {
+		result.DataURL = dataURL("image/"+format, data)
+		return result, nil
+	}
+
+	resized := resizeImage(img, rect, result.Width, result.Height)
+	var buf bytes.Buffer
+	mediaType := "image/png"
+	if format == "jpeg" {
+		mediaType = "image/jpeg"
+		err = jpeg.Encode(&buf, resized, &jpeg.Options{Quality: 90})
+	} else {
+		err = png.Encode(&buf, resized)
+	}
+	if err != nil {
+		return OptimizedImage{}, fmt.Errorf("encoding image: %w", err)
+	}
+	result.DataURL = dataURL(mediaType, buf.Bytes())
+
+	return result, nil
+}
+
+func dataURL(mediaType string, data []byte) string {
+	return "data:" + mediaType + ";base64," + base64.StdEncoding.EncodeToString(data)
+}
+
+// scaledImageSize returns the size OpenAI scales a high detail image to
+// before cutting it into tiles. Images are never scaled up.
+func scaledImageSize(width, height int) (int, int) {
+	w, h := fitImage(width, height, imageMaxEdge, imageMaxEdge)
+	if short := intMin(w, h); short > imageShortEdge {
+		w, h = fitImage(w, h, w*imageShortEdge/short, h*imageShortEdge/short)
+	}
+	return w, h
+}
+
+// fitImage returns the size of an image scaled down, keeping its aspect
+// ratio, to fit in maxWidth by maxHeight.
+func fitImage(width, height, maxWidth, maxHeight int) (int, int) {
+	scale := math.Min(float64(maxWidth)/float64(width), float64(maxHeight)/float64(height))
+	if scale >= 1 {
+		return width, height
+	}
+	w := int(math.Max(1, math.Floor(float64(width)*scale)))
+	h := int(math.Max(1, math.Floor(float64(height)*scale)))
+	return w, h
+}
+
+// bestTileGrid returns the grid of at most maxTiles tiles that keeps the
+// most of a w by h image: the most pixels when scaling, or the most area
+// when cropping.
+func bestTileGrid(w, h, maxTiles int, crop bool) (tx, ty int) {
+	var best float64
+	for x := 1; x <= maxTiles; x++ {
+		y := maxTiles / x
+		gw, gh := float64(x*imageTileSize), float64(y*imageTileSize)
+		var kept float64
+		if crop {
+			kept = math.Min(gw, float64(w)) * math.Min(gh, float64(h))
+		} else {
+			scale := math.Min(1, math.Min(gw/float64(w), gh/float64(h)))
+			kept = scale * scale
+		}
+		if kept > best {
+			best, tx, ty = kept, x, y
+		}
+	}
+	return tx, ty
+}
+
+// cropRect returns the centered rectangle of an image that, once the image
+// is scaled to w by h, fits a tx by ty grid of tiles.
+func cropRect(bounds image.Rectangle, w, h, tx, ty int) image.Rectangle {
+	cw := bounds.Dx() * intMin(w, tx*imageTileSize) / w
+	ch := bounds.Dy() * intMin(h, ty*imageTileSize) / h
+	x := bounds.Min.X + (bounds.Dx()-cw)/2
+	y := bounds.Min.Y + (bounds.Dy()-ch)/2
+	return image.Rect(x, y, x+cw, y+ch)
+}
+
+// resizeImage scales the rect of img to width by height, averaging the
+// source pixels each destination pixel covers.
+func resizeImage(img image.Image, rect image.Rectangle, width, height int) *image.RGBA {
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	sw, sh := rect.Dx(), rect.Dy()
+
+	for y := 0; y < height; y++ {
+		y0 := rect.Min.Y + y*sh/height
+		y1 := intMax(y0+1, rect.Min.Y+(y+1)*sh/height)
+		for x := 0; x < width; x++ {
+			x0 := rect.Min.X + x*sw/width
+			x1 := intMax(x0+1, rect.Min.X+(x+1)*sw/width)
+
+			var r, g, b, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					c := color.RGBA64Model.Convert(img.At(sx, sy)).(color.RGBA64)
+					r, g, b, a = r+uint64(c.R), g+uint64(c.G), b+uint64(c.B), a+uint64(c.A)
+					n++
+				}
+			}
+			dst.SetRGBA(x, y, color.RGBA{
+				R: uint8(r / n >> 8),
+				G: uint8(g / n >> 8),
+				B: uint8(b / n >> 8),
+				A: uint8(a / n >> 8),
+			})
+		}
+	}
+
+	return dst
+}
+
+func intMin(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func intMax(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,61 @@
+package tokens
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"testing"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+func TestOptimizeImage(t *testing.T) {
+	encode := func(w, h int) []byte {
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, image.NewGray(image.Rect(0, 0, w, h))); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+	screenshot := encode(1600, 1200)
+
+	tests := []struct {
+		name       string
+		data       []byte
+		opts       ImageOptions
+		wantWidth  int
+		wantHeight int
+		wantBefore int
+		wantAfter  int
+	}{
+		// OpenAI scales to 1024x768, 4 tiles.
+		{"Scaled", screenshot, ImageOptions{}, 1024, 768, 4, 4},
+		{"Max tiles", screenshot, ImageOptions{MaxTiles: 2}, 682, 512, 4, 2},
+		{"Crop", screenshot, ImageOptions{MaxTiles: 2, Crop: true}, 1024, 512, 4, 2},
+		{"Low detail", screenshot, ImageOptions{Detail: "low"}, 512, 384, 0, 0},
+		{"Small", encode(300, 200), ImageOptions{MaxTiles: 1}, 300, 200, 1, 1},
+	}
+
+	c := newTestCounter(t, openai.GPT4o)
+	for _, tt := range tests {
+		got, err := c.OptimizeImage(tt.data, tt.opts)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if got.Width != tt.wantWidth || got.Height != tt.wantHeight ||
+			got.TilesBefore != tt.wantBefore || got.TilesAfter != tt.wantAfter {
+			t.Errorf("%s: got %dx%d, %d tiles before and %d after, want %dx%d, %d and %d", tt.name,
+				got.Width, got.Height, got.TilesBefore, got.TilesAfter,
+				tt.wantWidth, tt.wantHeight, tt.wantBefore, tt.wantAfter)
+		}
+
+		cfg, ok := imageConfig(got.DataURL)
+		if !ok || cfg.Width != got.Width || cfg.Height != got.Height {
+			t.Errorf("%s: data URL is %dx%d, want %dx%d", tt.name, cfg.Width, cfg.Height, got.Width, got.Height)
+		}
+		if tokens := c.imageTokens(got.DataURL, tt.opts.Detail); tokens != got.TokensAfter {
+			t.Errorf("%s: data URL costs %d tokens, want %d", tt.name, tokens, got.TokensAfter)
+		}
+	}
+}
@@ -0,0 +1,371 @@
+package tokens
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+// UsageEvent records the tokens consumed by a single call to a model.
+type UsageEvent struct {
+	Tenant           string    `json:"tenant"`
+	Model            string    `json:"model"`
+	Time             time.Time `json:"time"`
+	PromptTokens     int       `json:"prompt_tokens"`
+	CompletionTokens int       `json:"completion_tokens"`
+	CachedTokens     int       `json:"cached_tokens,omitempty"`
+	// RejectedPredictionTokens are the completion tokens billed for a
+	// predicted output the model didn't use. They're a subset of
+	// CompletionTokens.
+	RejectedPredictionTokens int `json:"rejected_prediction_tokens,omitempty"`
+	// Estimated is true when the counts came from a Counter rather than from
+	// the usage reported by OpenAI, e.g. for streaming requests.
+	Estimated bool    `json:"estimated"`
+	Cost      float64 `json:"cost"`
+}
+
+// EstimateUsage returns a usage event for a request and its response using
+// the counter's own token counts. It's intended for streaming calls, where
+// OpenAI doesn't report usage.
+func (c *Counter) EstimateUsage(
+	tenant string,
+	req openai.ChatCompletionRequest,
+	resp openai.ChatCompletionResponse,
+) UsageEvent {
+	return UsageEvent{
+		Tenant:           tenant,
+		Model:            c.model,
+		PromptTokens:     c.CountRequestTokens(req),
+		CompletionTokens: sumChoiceTokens(c.countChoices(req, choicesFromOpenAI(resp))),
+		Estimated:        true,
+	}
+}
+
+// ReportedUsage returns a usage event for the usage reported by OpenAI.
+// openai.Usage doesn't include cached tokens, so cached prompt tokens are
+// billed at the full input rate; use ReportedResponseUsage to count them.
+func ReportedUsage(tenant, model string, usage openai.Usage) UsageEvent {
+	return UsageEvent{
+		Tenant:           tenant,
+		Model:            model,
+		PromptTokens:     usage.PromptTokens,
+		CompletionTokens: usage.CompletionTokens,
+	}
+}
+
+// ReportedResponseUsage returns a usage event for the usage reported in a
+// chat completion response, given as JSON or as any value that marshals to
+// it. Unlike ReportedUsage it reads usage.prompt_tokens_details and
+// usage.completion_tokens_details, which go-openai doesn't model, so cached
+// and rejected prediction tokens are recorded.
+func ReportedResponseUsage(tenant string, resp any) (UsageEvent, error) {
+	b, err := wireJSON(resp)
+	if err != nil {
+		return UsageEvent{}, err
+	}
+	var wire struct {
+		Model string `json:"model"`
+		Usage struct {
+			PromptTokens        int `json:"prompt_tokens"`
+			CompletionTokens    int `json:"completion_tokens"`
+			PromptTokensDetails struct {
+				CachedTokens int `json:"cached_tokens"`
+			} `json:"prompt_tokens_details"`
+			CompletionTokensDetails CompletionTokensDetails `json:"completion_tokens_details"`
+		} `json:"usage"`
+	}
+	if err := json.Unmarshal(b, &wire); err != nil {
+		return UsageEvent{}, &RequestError{Path: "usage", Err: err}
+	}
+
+	return UsageEvent{
+		Tenant:                   tenant,
+		Model:                    wire.Model,
+		PromptTokens:             wire.Usage.PromptTokens,
+		CompletionTokens:         wire.Usage.CompletionTokens,
+		CachedTokens:             wire.Usage.PromptTokensDetails.CachedTokens,
+		RejectedPredictionTokens: wire.Usage.CompletionTokensDetails.RejectedPredictionTokens,
+	}, nil
+}
+
+// UsageKey identifies a ledger aggregate. Day is formatted as "2006-01-02" in
+// UTC.
+type UsageKey struct {
+	Tenant string
+	Model  string
+	Day    string
+}
+
+// UsageTotal is the aggregated usage for a UsageKey.
+type UsageTotal struct {
+	Events           int
+	EstimatedEvents  int
+	PromptTokens     int
+	CompletionTokens int
+	CachedTokens     int
+	// RejectedPredictionTokens are included in CompletionTokens.
+	RejectedPredictionTokens int
+	Cost                     float64
+}
+
+func (t *UsageTotal) add(e UsageEvent) {
+	t.Events++
+	if e.Estimated {
+		t.EstimatedEvents++
+	}
+	t.PromptTokens += e.PromptTokens
+	t.CompletionTokens += e.CompletionTokens
+	t.CachedTokens += e.CachedTokens
+	t.RejectedPredictionTokens += e.RejectedPredictionTokens
+	t.Cost += e.Cost
+}
+
+// LedgerStore persists usage events for a Ledger.
+type LedgerStore interface {
+	// Append durably stores an event.
+	Append(e UsageEvent) error
+	// Replay calls fn with every stored event in the order they were
+	// appended.
+	Replay(fn func(UsageEvent) error) error
+	Close() error
+}
+
+// Ledger records usage events and aggregates them by tenant, model and day.
+// It's safe for concurrent use.
+type Ledger struct {
+	mu     sync.Mutex
+	store  LedgerStore
+	prices PriceTable
+	totals map[UsageKey]*UsageTotal
+}
+
+// NewLedger creates a ledger backed by store, replaying any events already in
+// it. Events recorded without a cost are priced using prices, which may be
+// nil.
+func NewLedger(store LedgerStore, prices PriceTable) (*Ledger, error) {
+	l := &Ledger{
+		store:  store,
+		prices: prices,
+		totals: make(map[UsageKey]*UsageTotal),
+	}
+
+	err := store.Replay(func(e UsageEvent) error {
+		l.aggregate(e)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("replay ledger: %w", err)
+	}
+
+	return l, nil
+}
+
+// Record prices, stores and aggregates an event. Events without a time are
+// recorded at the current time.
+func (l *Ledger) Record(e UsageEvent) error {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	e.Time = e.Time.UTC()
+	if e.Cost == 0 {
+		if p, ok := l.prices.Lookup(e.Model); ok {
+			e.Cost = p.Cost(e.PromptTokens, e.CachedTokens, e.CompletionTokens)
+		}
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err := l.store.Append(e); err != nil {
+		return err
+	}
+	l.aggregate(e)
+
+	return nil
+}
+
+func (l *Ledger) aggregate(e UsageEvent) {
+	key := UsageKey{
+		Tenant: e.Tenant,
+		Model:  e.Model,
+		Day:    e.Time.UTC().Format("2006-01-02"),
+	}
+	t, ok := l.totals[key]
+	if !ok {
+		t = &UsageTotal{}
+		l.totals[key] = t
+	}
+	t.add(e)
+}
+
+// Totals returns the aggregates whose keys match. A nil match returns every
+// aggregate.
+func (l *Ledger) Totals(match func(UsageKey) bool) map[UsageKey]UsageTotal {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	out := make(map[UsageKey]UsageTotal)
+	for k, t := range l.totals {
+		if match == nil || match(k) {
+			out[k] = *t
+		}
+	}
+
+	return out
+}
+
+// TenantTotal returns a tenant's usage across every model and day.
+func (l *Ledger) TenantTotal(tenant string) UsageTotal {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var total UsageTotal
+	for k, t := range l.totals {
+		if k.Tenant != tenant {
+			continue
+		}
+		total.Events += t.Events
+		total.EstimatedEvents += t.EstimatedEvents
+		total.PromptTokens += t.PromptTokens
+		total.CompletionTokens += t.CompletionTokens
+		total.CachedTokens += t.CachedTokens
+		total.RejectedPredictionTokens += t.RejectedPredictionTokens
+		total.Cost += t.Cost
+	}
+
+	return total
+}
+
+// Close closes the underlying store.
+func (l *Ledger) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.store.Close()
+}
+
+// MemoryStore is a LedgerStore that keeps events in memory.
+type MemoryStore struct {
+	mu     sync.Mutex
+	events []UsageEvent
+}
+
+// NewMemoryStore creates an empty in-memory store.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{}
+}
+
+func (s *MemoryStore) Append(e UsageEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events = append(s.events, e)
+	return nil
+}
+
+func (s *MemoryStore) Replay(fn func(UsageEvent) error) error {
+	s.mu.Lock()
+	events := append([]UsageEvent(nil), s.events...)
+	s.mu.Unlock()
+
+	for _, e := range events {
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStore) Close() error {
+	return nil
+}
+
+// FileStore is an append-only LedgerStore that writes one JSON event per line.
+type FileStore struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+// OpenFileStore opens, or creates, a JSONL ledger file.
+func OpenFileStore(path string) (*FileStore, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return &FileStore{file: f}, nil
+}
+
+// Append writes the event and syncs the file before returning.
+func (s *FileStore) Append(e UsageEvent) error {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := s.file.Seek(0, io.SeekEnd); err != nil {
+		return err
+	}
+	if _, err := s.file.Write(line); err != nil {
+		return err
+	}
+	return s.file.Sync()
+}
+
+// Replay reads every event in the file. A crash during Append can leave a
+// partial last line; it's truncated away so later appends start on a clean
+// line. A malformed line anywhere else is an error.
+func (s *FileStore) Replay(fn func(UsageEvent) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := s.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	var (
+		r      = bufio.NewReader(s.file)
+		offset int64
+		lineNo int
+	)
+	for {
+		line, err := r.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			if len(line) > 0 {
+				// Partial write from a crash.
+				return s.file.Truncate(offset)
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		lineNo++
+
+		if len(bytes.TrimSpace(line)) > 0 {
+			var e UsageEvent
+			if err := json.Unmarshal(line, &e); err != nil {
+				return fmt.Errorf("line %d: %w", lineNo, err)
+			}
+			if err := fn(e); err != nil {
+				return err
+			}
+		}
+		offset += int64(len(line))
+	}
+}
+
+func (s *FileStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.file.Close()
+}
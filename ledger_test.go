@@ -0,0 +1,148 @@
+package tokens
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLedgerTotals(t *testing.T) {
+	ledger, err := NewLedger(NewMemoryStore(), DefaultPrices)
+	if err != nil {
+		t.Fatalf("NewLedger: %v", err)
+	}
+
+	day1 := time.Date(2024, 6, 22, 10, 0, 0, 0, time.UTC)
+	day2 := day1.Add(24 * time.Hour)
+	events := []UsageEvent{
+		{Tenant: "acme", Model: "gpt-4o-mini", Time: day1, PromptTokens: 1000, CompletionTokens: 100},
+		{Tenant: "acme", Model: "gpt-4o-mini", Time: day1, PromptTokens: 2000, CompletionTokens: 200, Estimated: true},
+		{Tenant: "acme", Model: "gpt-4o-mini", Time: day2, PromptTokens: 500},
+		{Tenant: "globex", Model: "gpt-4o", Time: day1, PromptTokens: 10, Cost: 1},
+	}
+	for _, e := range events {
+		if err := ledger.Record(e); err != nil {
+			t.Fatalf("Record: %v", err)
+		}
+	}
+
+	got := ledger.Totals(nil)[UsageKey{Tenant: "acme", Model: "gpt-4o-mini", Day: "2024-06-22"}]
+	if got.Events != 2 || got.EstimatedEvents != 1 || got.PromptTokens != 3000 || got.CompletionTokens != 300 {
+		t.Errorf("acme day 1: got %+v", got)
+	}
+	if want := (3000*0.15 + 300*0.60) / 1e6; !closeTo(got.Cost, want) {
+		t.Errorf("acme day 1 cost: got %v, want %v", got.Cost, want)
+	}
+
+	if got := ledger.TenantTotal("acme"); got.PromptTokens != 3500 {
+		t.Errorf("acme prompt tokens: got %d, want 3500", got.PromptTokens)
+	}
+	if got := ledger.TenantTotal("globex"); got.Cost != 1 {
+		t.Errorf("globex cost: got %v, want explicit cost 1", got.Cost)
+	}
+}
+
+func TestFileStoreReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ledger.jsonl")
+
+	store, err := OpenFileStore(path)
+	if err != nil {
+		t.Fatalf("OpenFileStore: %v", err)
+	}
+	ledger, err := NewLedger(store, nil)
+	if err != nil {
+		t.Fatalf("NewLedger: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		err := ledger.Record(UsageEvent{Tenant: "acme", Model: "gpt-4o", PromptTokens: 10})
+		if err != nil {
+			t.Fatalf("Record: %v", err)
+		}
+	}
+	if err := ledger.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	// Simulate a crash part way through writing an event.
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"tenant":"acme","model":"gp`)
+	f.Close()
+
+	store, err = OpenFileStore(path)
+	if err != nil {
+		t.Fatalf("OpenFileStore: %v", err)
+	}
+	ledger, err = NewLedger(store, nil)
+	if err != nil {
+		t.Fatalf("NewLedger after crash: %v", err)
+	}
+	defer ledger.Close()
+
+	if got := ledger.TenantTotal("acme"); got.Events != 3 || got.PromptTokens != 30 {
+		t.Errorf("after replay: got %+v, want 3 events and 30 prompt tokens", got)
+	}
+
+	if err := ledger.Record(UsageEvent{Tenant: "acme", Model: "gpt-4o", PromptTokens: 10}); err != nil {
+		t.Fatalf("Record: %v", err)
+	}
+	var replayed int
+	if err := store.Replay(func(UsageEvent) error { replayed++; return nil }); err != nil {
+		t.Fatalf("Replay: %v", err)
+	}
+	if replayed != 4 {
+		t.Errorf("replayed %d events, want 4", replayed)
+	}
+}
+
+func closeTo(a, b float64) bool {
+	d := a - b
+	return d < 1e-12 && d > -1e-12
+}
+
+func TestReportedResponseUsage(t *testing.T) {
+	resp := `{
+		"model": "gpt-4o-2024-08-06",
+		"usage": {
+			"prompt_tokens": 2006,
+			"completion_tokens": 300,
+			"prompt_tokens_details": {"cached_tokens": 1920},
+			"completion_tokens_details": {"accepted_prediction_tokens": 100, "rejected_prediction_tokens": 40}
+		}
+	}`
+	got, err := ReportedResponseUsage("acme", []byte(resp))
+	if err != nil {
+		t.Fatalf("ReportedResponseUsage: %v", err)
+	}
+	want := UsageEvent{
+		Tenant:                   "acme",
+		Model:                    "gpt-4o-2024-08-06",
+		PromptTokens:             2006,
+		CompletionTokens:         300,
+		CachedTokens:             1920,
+		RejectedPredictionTokens: 40,
+	}
+	if got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	ledger, err := NewLedger(NewMemoryStore(), DefaultPrices)
+	if err != nil {
+		t.Fatalf("NewLedger: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := ledger.Record(got); err != nil {
+			t.Fatalf("Record: %v", err)
+		}
+	}
+	total := ledger.TenantTotal("acme")
+	if total.CachedTokens != 3840 || total.RejectedPredictionTokens != 80 {
+		t.Errorf("total: got %+v, want 3840 cached and 80 rejected prediction tokens", total)
+	}
+	if want := 2 * (86*2.50 + 1920*1.25 + 300*10.00) / 1e6; !closeTo(total.Cost, want) {
+		t.Errorf("cost: got %v, want %v", total.Cost, want)
+	}
+}
@@ -0,0 +1,82 @@
+package tokens
+
+import (
+	"strings"
+)
+
+// ContextWindows maps model names to the maximum number of tokens, prompt and
+// completion combined, that the model accepts. Embedding models list their
+// per-input limit.
+var ContextWindows = map[string]int{
+	"gpt-4o":                 128000,
+	"gpt-4o-mini":            128000,
+	"gpt-4-turbo":            128000,
+	"gpt-4-turbo-preview":    128000,
+	"gpt-4-1106-preview":     128000,
+	"gpt-4-0125-preview":     128000,
+	"gpt-4-vision-preview":   128000,
+	"gpt-4":                  8192,
+	"gpt-4-32k":              32768,
+	"gpt-3.5-turbo":          16385,
+	"gpt-3.5-turbo-0301":     4096,
+	"gpt-3.5-turbo-0613":     4096,
+	"gpt-3.5-turbo-instruct": 4096,
+	"text-embedding-3-small": 8191,
+	"text-embedding-3-large": 8191,
+	"text-embedding-ada-002": 8191,
+}
+
+// ContextWindow returns the context window for a model. Dated snapshots fall
+// back to the longest model name they start with, so snapshots whose window
+// differs from their family's, such as "gpt-4-1106-preview", are listed.
+func ContextWindow(model string) (int, bool) {
+	return lookupModel(ContextWindows, model)
+}
+
+// MaxOutputTokens maps model names to the most completion tokens the model
+// generates for one choice when max_tokens isn't set.
+var MaxOutputTokens = map[string]int{
+	"gpt-4o":                 16384,
+	"gpt-4o-2024-05-13":      4096,
+	"gpt-4o-mini":            16384,
+	"gpt-4-turbo":            4096,
+	"gpt-4-turbo-preview":    4096,
+	"gpt-4-1106-preview":     4096,
+	"gpt-4-0125-preview":     4096,
+	"gpt-4-vision-preview":   4096,
+	"gpt-4":                  8192,
+	"gpt-4-32k":              32768,
+	"gpt-3.5-turbo":          4096,
+	"gpt-3.5-turbo-instruct": 4096,
+}
+
+// MaxOutputTokensFor returns the most completion tokens a model generates
+// for one choice. Dated snapshots fall back to the longest model name they
+// start with.
+func MaxOutputTokensFor(model string) (int, bool) {
+	return lookupModel(MaxOutputTokens, model)
+}
+
+// lookupModel finds model in m, falling back to the longest key that model
+// starts with followed by a "-", e.g. "gpt-4o-2024-08-06" matches "gpt-4o".
+func lookupModel[V any](m map[string]V, model string) (V, bool) {
+	if v, ok := m[model]; ok {
+		return v, true
+	}
+
+	var (
+		best  string
+		found bool
+	)
+	for name := range m {
+		if strings.HasPrefix(model, name+"-") && len(name) > len(best) {
+			best = name
+			found = true
+		}
+	}
+	if !found {
+		var zero V
+		return zero, false
+	}
+	return m[best], true
+}
@@ -0,0 +1,105 @@
+package tokens
+
+import (
+	"encoding/json"
+)
+
+// CompletionTokensDetails is the breakdown of a response's completion tokens
+// reported in its usage, which go-openai doesn't model yet.
+type CompletionTokensDetails struct {
+	ReasoningTokens          int `json:"reasoning_tokens"`
+	AudioTokens              int `json:"audio_tokens"`
+	AcceptedPredictionTokens int `json:"accepted_prediction_tokens"`
+	RejectedPredictionTokens int `json:"rejected_prediction_tokens"`
+}
+
+// PredictionUsage is how much of a request's predicted output a response
+// used.
+type PredictionUsage struct {
+	// Predicted is the tokens of the prediction, counted from the request.
+	Predicted int `json:"predicted"`
+	// Accepted and Rejected are the prediction tokens the response reports
+	// it accepted and rejected. Predicted tokens that were neither are
+	// tokens the model didn't need to check, so aren't billed.
+	Accepted int `json:"accepted"`
+	Rejected int `json:"rejected"`
+	// Completion is the reported completion tokens, which include the
+	// rejected prediction tokens.
+	Completion int `json:"completion"`
+}
+
+// Generated returns the completion tokens of the response's own output,
+// accepted prediction tokens included.
+func (u PredictionUsage) Generated() int {
+	return u.Completion - u.Rejected
+}
+
+// CountPredictionTokens returns the tokens of the predicted output of a chat
+// completion request, given in any form CountChatRequest accepts, or 0 if it
+// has none. Predictions aren't billed as prompt tokens.
+func (c *Counter) CountPredictionTokens(req any) (int, error) {
+	r, err := chatRequestFrom(req)
+	if err != nil {
+		return 0, err
+	}
+	return c.CountTokens(r.prediction), nil
+}
+
+// MaxPredictedCompletionTokens returns the most completion tokens a chat
+// completion request with a predicted output can be billed for. Rejected
+// prediction tokens are billed as completion tokens on top of the output, so
+// the worst case is a rejected prediction and a full completion: max_tokens
+// for each choice or, when max_tokens isn't set, the most the counter's model
+// can generate. Without max_tokens a model missing from MaxOutputTokens has
+// no bound, and an error is returned.
+func (c *Counter) MaxPredictedCompletionTokens(req any) (int, error) {
+	r, err := chatRequestFrom(req)
+	if err != nil {
+		return 0, err
+	}
+	predicted := c.CountTokens(r.prediction)
+
+	n := r.n
+	if n < 1 {
+		n = 1
+	}
+	output, err := c.maxOutputTokens(r.maxTokens)
+	if err != nil {
+		return 0, err
+	}
+
+	return n * (output + predicted), nil
+}
+
+// CountPredictionUsage returns how much of a request's predicted output its
+// response used. The request is given in any form CountChatRequest accepts,
+// and the response as JSON or as any value that marshals to it, since the
+// accepted and rejected prediction tokens are only in the wire format's
+// usage.completion_tokens_details.
+func (c *Counter) CountPredictionUsage(req any, resp any) (PredictionUsage, error) {
+	predicted, err := c.CountPredictionTokens(req)
+	if err != nil {
+		return PredictionUsage{}, err
+	}
+
+	b, err := wireJSON(resp)
+	if err != nil {
+		return PredictionUsage{}, err
+	}
+	var wire struct {
+		Usage struct {
+			CompletionTokens int                     `json:"completion_tokens"`
+			Details          CompletionTokensDetails `json:"completion_tokens_details"`
+		} `json:"usage"`
+	}
+	if err := json.Unmarshal(b, &wire); err != nil {
+		return PredictionUsage{}, &RequestError{Path: "usage", Err: err}
+	}
+
+	return PredictionUsage{
+		Predicted:  predicted,
+		Accepted:   wire.Usage.Details.AcceptedPredictionTokens,
+		Rejected:   wire.Usage.Details.RejectedPredictionTokens,
+		Completion: wire.Usage.CompletionTokens,
+	}, nil
+}
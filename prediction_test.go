@@ -0,0 +1,67 @@
+package tokens
+
+import (
+	"testing"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+func TestPrediction(t *testing.T) {
+	c := newTestCounter(t, openai.GPT4o)
+
+	code := "func add(a, b int) int {\n\treturn a + b\n}\n"
+	req := ChatRequest{
+		ChatCompletionRequest: openai.ChatCompletionRequest{
+			Model: openai.GPT4o,
+			Messages: []openai.ChatCompletionMessage{{
+				Role:    openai.ChatMessageRoleUser,
+				Content: "Rename add to sum.",
+			}},
+		},
+		Prediction: &Prediction{Type: "content", Content: code},
+	}
+
+	predicted, err := c.CountPredictionTokens(req)
+	if err != nil || predicted != len(code) {
+		t.Errorf("CountPredictionTokens: got %d, %v, want %d", predicted, err, len(code))
+	}
+
+	// Without max_tokens the completion may be as long as the model allows.
+	if got, err := c.MaxPredictedCompletionTokens(req); err != nil || got != 16384+len(code) {
+		t.Errorf("MaxPredictedCompletionTokens: got %d, %v, want %d", got, err, 16384+len(code))
+	}
+	if _, err := newTestCounter(t, "my-own-model").MaxPredictedCompletionTokens(req); err == nil {
+		t.Error("MaxPredictedCompletionTokens for an unknown model: got nil error")
+	}
+	wire := `{
+		"model": "gpt-4o",
+		"messages": [{"role": "user", "content": "Rename add to sum."}],
+		"prediction": {"type": "content", "content": [{"type": "text", "text": "func add"}]},
+		"max_completion_tokens": 100
+	}`
+	if got, err := c.MaxPredictedCompletionTokens([]byte(wire)); err != nil || got != 100+len("func add") {
+		t.Errorf("MaxPredictedCompletionTokens(wire): got %d, %v, want %d", got, err, 100+len("func add"))
+	}
+
+	resp := `{
+		"choices": [{"index": 0, "message": {"role": "assistant", "content": "func sum(a, b int) int {\n\treturn a + b\n}\n"}}],
+		"usage": {
+			"prompt_tokens": 20,
+			"completion_tokens": 60,
+			"completion_tokens_details": {"accepted_prediction_tokens": 30, "rejected_prediction_tokens": 12}
+		}
+	}`
+	usage, err := c.CountPredictionUsage(req, []byte(resp))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := PredictionUsage{Predicted: len(code), Accepted: 30, Rejected: 12, Completion: 60}
+	if usage != want || usage.Generated() != 48 {
+		t.Errorf("CountPredictionUsage: got %+v, want %+v", usage, want)
+	}
+
+	output, rejected := Price{Output: 10}.PredictionCost(usage)
+	if output != 48*10/1e6 || rejected != 12*10/1e6 {
+		t.Errorf("PredictionCost: got %v and %v", output, rejected)
+	}
+}
@@ -0,0 +1,87 @@
+package tokens
+
+// Price is the cost of a model in US dollars per million tokens. Audio
+// models bill audio tokens at their own rates.
+type Price struct {
+	Input       float64
+	CachedInput float64
+	Output      float64
+	AudioInput  float64
+	AudioOutput float64
+}
+
+// Cost returns the cost in US dollars of the given token counts. Cached tokens
+// are a subset of prompt tokens and are billed at the cached input rate.
+func (p Price) Cost(promptTokens, cachedTokens, completionTokens int) float64 {
+	cachedRate := p.CachedInput
+	if cachedRate == 0 {
+		cachedRate = p.Input
+	}
+	uncached := promptTokens - cachedTokens
+	if uncached < 0 {
+		uncached = 0
+	}
+
+	return (float64(uncached)*p.Input +
+		float64(cachedTokens)*cachedRate +
+		float64(completionTokens)*p.Output) / 1e6
+}
+
+// BreakdownCost returns the cost in US dollars of prompt and completion
+// tokens split into text and audio, as returned by CountRequestBreakdown and
+// CountResponseBreakdown. Audio tokens without an audio rate are billed as
+// text.
+func (p Price) BreakdownCost(prompt, completion TokenBreakdown) float64 {
+	audioInput, audioOutput := p.AudioInput, p.AudioOutput
+	if audioInput == 0 {
+		audioInput = p.Input
+	}
+	if audioOutput == 0 {
+		audioOutput = p.Output
+	}
+
+	return (float64(prompt.Text)*p.Input +
+		float64(prompt.Audio)*audioInput +
+		float64(completion.Text)*p.Output +
+		float64(completion.Audio)*audioOutput) / 1e6
+}
+
+// PredictionCost returns the cost in US dollars of a response's completion
+// tokens split into its own output and the rejected prediction tokens billed
+// on top of it.
+func (p Price) PredictionCost(u PredictionUsage) (output, rejected float64) {
+	return float64(u.Generated()) * p.Output / 1e6, float64(u.Rejected) * p.Output / 1e6
+}
+
+// PriceTable maps model names to their prices.
+type PriceTable map[string]Price
+
+// DefaultPrices are OpenAI's published list prices. They change, so callers
+// billing real customers should supply their own table.
+var DefaultPrices = PriceTable{
+	"gpt-4o":                    {Input: 2.50, CachedInput: 1.25, Output: 10.00},
+	"gpt-4o-2024-05-13":         {Input: 5.00, Output: 15.00},
+	"gpt-4o-mini":               {Input: 0.15, CachedInput: 0.075, Output: 0.60},
+	"gpt-4o-audio-preview":      {Input: 2.50, Output: 10.00, AudioInput: 40.00, AudioOutput: 80.00},
+	"gpt-4o-mini-audio-preview": {Input: 0.15, Output: 0.60, AudioInput: 10.00, AudioOutput: 20.00},
+	"gpt-4-turbo":               {Input: 10.00, Output: 30.00},
+	"gpt-4-1106-preview":        {Input: 10.00, Output: 30.00},
+	"gpt-4-0125-preview":        {Input: 10.00, Output: 30.00},
+	"gpt-4-vision-preview":      {Input: 10.00, Output: 30.00},
+	"gpt-4":                     {Input: 30.00, Output: 60.00},
+	"gpt-4-32k":                 {Input: 60.00, Output: 120.00},
+	"gpt-3.5-turbo":             {Input: 0.50, Output: 1.50},
+	"gpt-3.5-turbo-1106":        {Input: 1.00, Output: 2.00},
+	"gpt-3.5-turbo-0613":        {Input: 1.50, Output: 2.00},
+	"gpt-3.5-turbo-16k":         {Input: 3.00, Output: 4.00},
+	"gpt-3.5-turbo-instruct":    {Input: 1.50, Output: 2.00},
+	"text-embedding-3-small":    {Input: 0.02},
+	"text-embedding-3-large":    {Input: 0.13},
+	"text-embedding-ada-002":    {Input: 0.10},
+}
+
+// Lookup returns the price for a model. Dated snapshots such as
+// "gpt-4o-2024-08-06" fall back to the longest model name they start with.
+func (t PriceTable) Lookup(model string) (Price, bool) {
+	return lookupModel(t, model)
+}
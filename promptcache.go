@@ -0,0 +1,252 @@
+package tokens
+
+import (
+	"container/list"
+	"fmt"
+	"hash/fnv"
+	"sync"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+// OpenAI caches prompts in increments of promptCacheIncrement tokens once the
+// shared prefix is at least promptCacheMinTokens long.
+const (
+	promptCacheMinTokens = 1024
+	promptCacheIncrement = 128
+)
+
+// CachedTokens returns the number of cached tokens OpenAI reports for a
+// prompt that shares its first sharedPrefix tokens with a recent prompt.
+func CachedTokens(sharedPrefix int) int {
+	if sharedPrefix < promptCacheMinTokens {
+		return 0
+	}
+	return promptCacheMinTokens +
+		(sharedPrefix-promptCacheMinTokens)/promptCacheIncrement*promptCacheIncrement
+}
+
+// CachePrediction is the predicted prompt caching for a request.
+type CachePrediction struct {
+	PromptTokens int
+	// SharedPrefix is the longest prefix, in tokens, the request shares with
+	// a remembered prompt.
+	SharedPrefix int
+	CachedTokens int
+	// Cost is the prompt cost with caching, and UncachedCost without. Both
+	// are 0 if the model has no price.
+	Cost         float64
+	UncachedCost float64
+	// Divergence is where the request first differs from the remembered
+	// prompt it shares the most with. It's nil when nothing was remembered or
+	// the request is entirely a prefix of a remembered prompt.
+	Divergence *CacheDivergence
+}
+
+// CacheDivergence describes where a request stops matching a cached prompt.
+type CacheDivergence struct {
+	// Token is the offset of the first differing token.
+	Token int
+	// Message is the index in the request's messages of the message holding
+	// the first differing token, or -1 if it's in the tool definitions
+	// OpenAI adds as a system message, or after the messages.
+	Message int
+	Advice  string
+}
+
+// PromptCache remembers recently rendered prompts per model to predict how
+// much of a new request OpenAI will serve from its prompt cache. It's safe for
+// concurrent use.
+type PromptCache struct {
+	mu       sync.Mutex
+	capacity int
+	prices   PriceTable
+	models   map[string]*list.List
+}
+
+// NewPromptCache creates a cache remembering up to capacity prompts per model,
+// evicting the least recently used. Costs are computed with prices, which may
+// be nil.
+func NewPromptCache(capacity int, prices PriceTable) *PromptCache {
+	return &PromptCache{
+		capacity: capacity,
+		prices:   prices,
+		models:   make(map[string]*list.List),
+	}
+}
+
+// Predict returns the predicted caching for a request without remembering
+// it.
+func (p *PromptCache) Predict(
+	c *Counter,
+	req openai.ChatCompletionRequest,
+) CachePrediction {
+	r := c.render(fromOpenAI(req))
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	prediction, _ := p.predict(c.model, r, cacheKeys(r))
+	return prediction
+}
+
+// Observe returns the predicted caching for a request, as Predict does, and
+// remembers it for future requests.
+func (p *PromptCache) Observe(
+	c *Counter,
+	req openai.ChatCompletionRequest,
+) CachePrediction {
+	r := c.render(fromOpenAI(req))
+	keys := cacheKeys(r)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	prediction, best := p.predict(c.model, r, keys)
+
+	prompts := p.models[c.model]
+	if prompts == nil {
+		prompts = list.New()
+		p.models[c.model] = prompts
+	}
+	if best != nil {
+		prompts.MoveToFront(best)
+		if bestTokens := best.Value.([]int); len(bestTokens) == len(r.tokens) &&
+			prediction.SharedPrefix == len(r.tokens) {
+			// Already remembered.
+			return prediction
+		}
+	}
+	prompts.PushFront(keys)
+	for prompts.Len() > p.capacity {
+		prompts.Remove(prompts.Back())
+	}
+
+	return prediction
+}
+
+// predict must be called with the lock held. It returns the prediction and
+// the remembered prompt sharing the longest prefix with keys, the request's
+// cacheKeys.
+func (p *PromptCache) predict(model string, r renderedRequest, keys []int) (CachePrediction, *list.Element) {
+	var (
+		best       *list.Element
+		bestShared int
+	)
+	if prompts := p.models[model]; prompts != nil {
+		for e := prompts.Front(); e != nil; e = e.Next() {
+			shared := sharedPrefix(keys, e.Value.([]int))
+			if best == nil || shared > bestShared {
+				best = e
+				bestShared = shared
+			}
+		}
+	}
+
+	prediction := CachePrediction{
+		PromptTokens: len(r.tokens),
+		SharedPrefix: bestShared,
+		CachedTokens: CachedTokens(bestShared),
+	}
+	if prediction.CachedTokens > len(r.tokens) {
+		prediction.CachedTokens = len(r.tokens)
+	}
+	if price, ok := p.prices.Lookup(model); ok {
+		prediction.Cost = price.Cost(prediction.PromptTokens, prediction.CachedTokens, 0)
+		prediction.UncachedCost = price.Cost(prediction.PromptTokens, 0, 0)
+	}
+	if best != nil && bestShared < len(r.tokens) {
+		prediction.Divergence = divergence(r, bestShared)
+	}
+
+	return prediction, best
+}
+
+// cacheKeys returns the tokens a rendered request is cached by: its tokens,
+// with the placeholders of each image and audio part replaced by a hash of
+// the part's content, so different images of the same size don't match.
+func cacheKeys(r renderedRequest) []int {
+	if len(r.media) == 0 {
+		return r.tokens
+	}
+	keys := append([]int(nil), r.tokens...)
+	for _, m := range r.media {
+		// Negative, below tokenOverhead and tokenAudio, so a key never
+		// matches a real token or placeholder.
+		key := -3 - int(m.hash>>1)
+		for i := m.start; i < m.end; i++ {
+			keys[i] = key
+		}
+	}
+	return keys
+}
+
+// contentHash hashes the content of an image or audio part.
+func contentHash(content ...string) uint32 {
+	h := fnv.New32a()
+	for _, s := range content {
+		h.Write([]byte(s))
+		h.Write([]byte{0})
+	}
+	return h.Sum32()
+}
+
+func sharedPrefix(a, b []int) int {
+	n := len(a)
+	if len(b) < n {
+		n = len(b)
+	}
+	for i := 0; i < n; i++ {
+		if a[i] != b[i] {
+			return i
+		}
+	}
+	return n
+}
+
+// divergence locates the token at offset in the request's messages and
+// suggests how to cache more of it.
+func divergence(r renderedRequest, offset int) *CacheDivergence {
+	d := &CacheDivergence{Token: offset, Message: -1}
+	if offset >= r.end {
+		d.Advice = "the messages match a cached prompt; the request differs only after them, e.g. in its tool choice"
+		return d
+	}
+
+	var rendered int
+	for i, start := range r.starts {
+		if start > offset {
+			break
+		}
+		rendered = i
+	}
+	d.Message = rendered
+	if r.injectedSystem {
+		d.Message--
+	}
+
+	switch {
+	case d.Message < 0:
+		d.Advice = "the tool definitions differ from the cached prompt; keep tools identical and in the same order across requests"
+	case r.messages[rendered].role == openai.ChatMessageRoleSystem:
+		d.Advice = fmt.Sprintf(
+			"system message %d differs from the cached prompt; move content that changes between requests, such as dates or user details, to the end of the conversation",
+			d.Message,
+		)
+	default:
+		d.Advice = fmt.Sprintf(
+			"%s message %d is the first to differ from the cached prompt; keep earlier messages unchanged and append new content after them",
+			r.messages[rendered].role,
+			d.Message,
+		)
+	}
+	if offset < promptCacheMinTokens {
+		d.Advice += fmt.Sprintf(
+			"; only %d tokens match, fewer than the %d needed for caching",
+			offset,
+			promptCacheMinTokens,
+		)
+	}
+
+	return d
+}
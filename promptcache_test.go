@@ -0,0 +1,93 @@
+package tokens
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+func TestCachedTokens(t *testing.T) {
+	tests := []struct {
+		shared int
+		want   int
+	}{
+		{shared: 0, want: 0},
+		{shared: 1023, want: 0},
+		{shared: 1024, want: 1024},
+		{shared: 1151, want: 1024},
+		{shared: 1152, want: 1152},
+		{shared: 5000, want: 4992},
+	}
+	for _, tt := range tests {
+		if got := CachedTokens(tt.shared); got != tt.want {
+			t.Errorf("CachedTokens(%d): got %d, want %d", tt.shared, got, tt.want)
+		}
+	}
+}
+
+func TestCacheDivergence(t *testing.T) {
+	// Tool definitions injected as a system message, then a system message
+	// and a user message, each 2000 tokens long.
+	r := renderedRequest{
+		messages: []chatMessage{
+			{role: openai.ChatMessageRoleSystem},
+			{role: openai.ChatMessageRoleSystem},
+			{role: openai.ChatMessageRoleUser},
+		},
+		starts:         []int{0, 2000, 4000},
+		end:            6000,
+		injectedSystem: true,
+	}
+
+	tests := []struct {
+		offset      int
+		wantMessage int
+		wantAdvice  string
+	}{
+		{offset: 10, wantMessage: -1, wantAdvice: "tool definitions differ"},
+		{offset: 2500, wantMessage: 0, wantAdvice: "system message 0"},
+		{offset: 4000, wantMessage: 1, wantAdvice: "user message 1"},
+		{offset: 6001, wantMessage: -1, wantAdvice: "only after them"},
+	}
+	for _, tt := range tests {
+		d := divergence(r, tt.offset)
+		if d.Message != tt.wantMessage || !strings.Contains(d.Advice, tt.wantAdvice) {
+			t.Errorf("offset %d: got message %d %q, want %d %q", tt.offset, d.Message, d.Advice, tt.wantMessage, tt.wantAdvice)
+		}
+	}
+}
+
+func TestPromptCacheMedia(t *testing.T) {
+	c := newTestCounter(t, openai.GPT4o)
+	request := func(url string) openai.ChatCompletionRequest {
+		return openai.ChatCompletionRequest{
+			Model: openai.GPT4o,
+			Messages: []openai.ChatCompletionMessage{
+				{Role: openai.ChatMessageRoleSystem, Content: strings.Repeat("a", 2000)},
+				{Role: openai.ChatMessageRoleUser, MultiContent: []openai.ChatMessagePart{
+					{Type: openai.ChatMessagePartTypeImageURL, ImageURL: &openai.ChatMessageImageURL{URL: url, Detail: openai.ImageURLDetailLow}},
+					{Type: openai.ChatMessagePartTypeText, Text: strings.Repeat("b", 2000)},
+				}},
+			},
+		}
+	}
+
+	cache := NewPromptCache(10, nil)
+	cache.Observe(c, request("https://example.com/cat.png"))
+
+	same := cache.Predict(c, request("https://example.com/cat.png"))
+	if same.SharedPrefix != same.PromptTokens {
+		t.Errorf("same image: got shared prefix %d, want all %d tokens", same.SharedPrefix, same.PromptTokens)
+	}
+
+	// A different image of the same size renders the same placeholder
+	// tokens, but isn't cached.
+	other := cache.Predict(c, request("https://example.com/dog.png"))
+	if other.PromptTokens != same.PromptTokens {
+		t.Fatalf("different image: got %d prompt tokens, want %d", other.PromptTokens, same.PromptTokens)
+	}
+	if other.Divergence == nil || other.Divergence.Message != 1 || other.SharedPrefix > 2100 {
+		t.Errorf("different image: got shared prefix %d and divergence %+v, want a divergence in message 1", other.SharedPrefix, other.Divergence)
+	}
+}
@@ -0,0 +1,316 @@
+package tokens
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+// BuiltinToolTokens are the tokens of the instructions each of the Responses
+// API's built-in tools, such as "web_search_preview" or "file_search", adds
+// to the prompt. OpenAI doesn't publish these instructions, so built-in tools
+// aren't counted unless an entry is calibrated against reported usage.
+var BuiltinToolTokens = map[string]int{}
+
+// responsesRequest is the subset of a Responses API request that affects
+// the prompt.
+type responsesRequest struct {
+	Instructions string            `json:"instructions"`
+	Input        json.RawMessage   `json:"input"`
+	Tools        []json.RawMessage `json:"tools"`
+	ToolChoice   json.RawMessage   `json:"tool_choice"`
+	Text         *struct {
+		Format *struct {
+			Type        string                 `json:"type"`
+			Name        string                 `json:"name"`
+			Description string                 `json:"description"`
+			Schema      map[string]interface{} `json:"schema"`
+		} `json:"format"`
+	} `json:"text"`
+}
+
+// responsesItem is an input or output item: a message, a function call, a
+// function call's output or a reasoning item.
+type responsesItem struct {
+	Type    string          `json:"type"`
+	Role    string          `json:"role"`
+	Content json.RawMessage `json:"content"`
+
+	// function_call and function_call_output
+	CallID    string `json:"call_id"`
+	Name      string `json:"name"`
+	Arguments string `json:"arguments"`
+	Output    string `json:"output"`
+
+	// reasoning
+	Summary []struct {
+		Text string `json:"text"`
+	} `json:"summary"`
+}
+
+type responsesPart struct {
+	Type     string `json:"type"`
+	Text     string `json:"text"`
+	Refusal  string `json:"refusal"`
+	ImageURL string `json:"image_url"`
+	Detail   string `json:"detail"`
+}
+
+type responsesTool struct {
+	Type        string                 `json:"type"`
+	Name        string                 `json:"name"`
+	Description string                 `json:"description"`
+	Parameters  map[string]interface{} `json:"parameters"`
+}
+
+// CountResponsesRequest returns the input tokens of a Responses API request,
+// given as JSON or as any value that marshals to it, such as the request
+// parameters of the official openai-go SDK. Instructions, messages, function
+// calls and their outputs are rendered as the equivalent chat completions
+// request would be. Reasoning items count their summaries, since their
+// encrypted content can't be counted, and built-in tools count their
+// BuiltinToolTokens. Malformed requests return a *RequestError.
+func (c *Counter) CountResponsesRequest(req any) (int, error) {
+	b, err := wireJSON(req)
+	if err != nil {
+		return 0, err
+	}
+
+	var wire responsesRequest
+	if err := json.Unmarshal(b, &wire); err != nil {
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &typeErr) {
+			return 0, &RequestError{Path: typeErr.Field, Err: err}
+		}
+		return 0, &RequestError{Err: err}
+	}
+
+	var r chatRequest
+	if wire.Instructions != "" {
+		r.messages = append(r.messages, chatMessage{
+			role:  openai.ChatMessageRoleSystem,
+			parts: []contentPart{{kind: partText, text: wire.Instructions}},
+		})
+	}
+
+	items, err := responsesItems(wire.Input)
+	if err != nil {
+		return 0, &RequestError{Path: "input", Err: err}
+	}
+	messages, reasoning, err := responsesMessages(items, "input")
+	if err != nil {
+		return 0, err
+	}
+	r.messages = append(r.messages, messages...)
+
+	var builtin int
+	for i, raw := range wire.Tools {
+		var tool responsesTool
+		if err := json.Unmarshal(raw, &tool); err != nil {
+			return 0, &RequestError{Path: fmt.Sprintf("tools[%d]", i), Err: err}
+		}
+		if tool.Type != "function" {
+			builtin += BuiltinToolTokens[tool.Type]
+			continue
+		}
+		r.tools = append(r.tools, toolDef{
+			name:        tool.Name,
+			description: tool.Description,
+			parameters:  tool.Parameters,
+			path:        fmt.Sprintf("tools[%d]", i),
+		})
+	}
+
+	if r.toolChoice, err = responsesToolChoice(wire.ToolChoice); err != nil {
+		return 0, &RequestError{Path: "tool_choice", Err: err}
+	}
+
+	if wire.Text != nil && wire.Text.Format != nil && wire.Text.Format.Type == "json_schema" {
+		f := wire.Text.Format
+		r.responseFormat = &responseFormat{
+			name:        f.Name,
+			description: f.Description,
+			schema:      f.Schema,
+		}
+	}
+
+	count := len(c.render(r).tokens) + builtin
+	for _, text := range reasoning {
+		count += c.CountTokens(text)
+	}
+
+	return count, nil
+}
+
+// CountResponsesOutput returns the visible output tokens of a Responses API
+// response, given as JSON or as any value that marshals to it: the text of
+// output messages, function calls and reasoning summaries. Reasoning itself
+// is billed as output but isn't returned, so it's reported only in the
+// response's usage as output_tokens_details.reasoning_tokens.
+func (c *Counter) CountResponsesOutput(resp any) (int, error) {
+	b, err := wireJSON(resp)
+	if err != nil {
+		return 0, err
+	}
+
+	var wire struct {
+		Output []responsesItem `json:"output"`
+	}
+	if err := json.Unmarshal(b, &wire); err != nil {
+		return 0, &RequestError{Err: err}
+	}
+
+	messages, reasoning, err := responsesMessages(wire.Output, "output")
+	if err != nil {
+		return 0, err
+	}
+
+	var count int
+	for _, m := range messages {
+		// Output items are generated, so are counted as a chat completion's
+		// choices are.
+		count += len(c.encodeCompletion(m))
+	}
+	for _, text := range reasoning {
+		count += c.CountTokens(text)
+	}
+
+	return count, nil
+}
+
+// wireJSON returns the JSON of a request or response given as JSON or
+// as a value that marshals to it.
+func wireJSON(v any) ([]byte, error) {
+	switch b := v.(type) {
+	case []byte:
+		return b, nil
+	case json.RawMessage:
+		return b, nil
+	default:
+		encoded, err := json.Marshal(v)
+		if err != nil {
+			return nil, fmt.Errorf("unsupported request %T: %w", v, err)
+		}
+		return encoded, nil
+	}
+}
+
+// responsesItems decodes input, which is a string or an array of items.
+func responsesItems(input json.RawMessage) ([]responsesItem, error) {
+	if len(input) == 0 || string(input) == "null" {
+		return nil, nil
+	}
+
+	var text string
+	if err := json.Unmarshal(input, &text); err == nil {
+		content, _ := json.Marshal(text)
+		return []responsesItem{{Type: "message", Role: openai.ChatMessageRoleUser, Content: content}}, nil
+	}
+
+	var items []responsesItem
+	if err := json.Unmarshal(input, &items); err != nil {
+		return nil, errors.New("must be a string or an array of items")
+	}
+	return items, nil
+}
+
+// responsesMessages converts items to the equivalent chat messages.
+// Consecutive function calls become one assistant message with several tool
+// calls, as they would be in a chat completions request. The text of
+// reasoning summaries is returned separately.
+func responsesMessages(items []responsesItem, field string) ([]chatMessage, []string, error) {
+	var (
+		messages  []chatMessage
+		reasoning []string
+	)
+	for i, item := range items {
+		switch item.Type {
+		case "", "message":
+			parts, err := responsesParts(item.Content)
+			if err != nil {
+				return nil, nil, &RequestError{Path: fmt.Sprintf("%s[%d].content", field, i), Err: err}
+			}
+			messages = append(messages, chatMessage{role: item.Role, parts: parts})
+
+		case "function_call":
+			call := toolCall{id: item.CallID, name: item.Name, arguments: item.Arguments}
+			if n := len(messages); n > 0 && i > 0 && items[i-1].Type == "function_call" {
+				messages[n-1].toolCalls = append(messages[n-1].toolCalls, call)
+				continue
+			}
+			messages = append(messages, chatMessage{
+				role:      openai.ChatMessageRoleAssistant,
+				parts:     []contentPart{{kind: partText}},
+				toolCalls: []toolCall{call},
+			})
+
+		case "function_call_output":
+			messages = append(messages, chatMessage{
+				role:       openai.ChatMessageRoleTool,
+				parts:      []contentPart{{kind: partText, text: item.Output}},
+				toolCallID: item.CallID,
+			})
+
+		case "reasoning":
+			for _, s := range item.Summary {
+				reasoning = append(reasoning, s.Text)
+			}
+		}
+	}
+
+	return messages, reasoning, nil
+}
+
+// responsesParts converts message content, which is a string or an array of
+// input_text, output_text, refusal and input_image parts.
+func responsesParts(content json.RawMessage) ([]contentPart, error) {
+	var text string
+	if err := json.Unmarshal(content, &text); err == nil {
+		return []contentPart{{kind: partText, text: text}}, nil
+	}
+
+	var wireParts []responsesPart
+	if err := json.Unmarshal(content, &wireParts); err != nil {
+		return nil, errors.New("must be a string or an array of content parts")
+	}
+	var parts []contentPart
+	for _, p := range wireParts {
+		switch p.Type {
+		case "input_image":
+			parts = append(parts, contentPart{kind: partImage, imageURL: p.ImageURL, imageDetail: p.Detail})
+		case "refusal":
+			parts = append(parts, contentPart{kind: partText, text: p.Refusal})
+		default:
+			parts = append(parts, contentPart{kind: partText, text: p.Text})
+		}
+	}
+	return parts, nil
+}
+
+// responsesToolChoice converts a tool choice, which is "none", "auto",
+// "required", a function, {"type":"function","name":...}, or a built-in
+// tool, which is forced like "required".
+func responsesToolChoice(raw json.RawMessage) (toolChoice, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return toolChoice{}, nil
+	}
+
+	var mode string
+	if err := json.Unmarshal(raw, &mode); err == nil {
+		return toolChoice{mode: mode}, nil
+	}
+
+	var choice struct {
+		Type string `json:"type"`
+		Name string `json:"name"`
+	}
+	if err := json.Unmarshal(raw, &choice); err != nil {
+		return toolChoice{}, errors.New("must be a string or an object")
+	}
+	if choice.Type != toolChoiceFunction {
+		return toolChoice{mode: toolChoiceRequired}, nil
+	}
+	return toolChoice{mode: toolChoiceFunction, name: choice.Name}, nil
+}
@@ -0,0 +1,97 @@
+package tokens
+
+import (
+	"testing"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+func TestCountResponsesRequest(t *testing.T) {
+	c := newTestCounter(t, openai.GPT4o)
+
+	responses := `{
+		"model": "gpt-4o",
+		"instructions": "Be brief.",
+		"input": [
+			{"role": "user", "content": [{"type": "input_text", "text": "Weather in Vail and Aspen?"}]},
+			{"type": "reasoning", "id": "rs_1", "summary": [{"type": "summary_text", "text": "Check both."}], "encrypted_content": "gAAA"},
+			{"type": "function_call", "call_id": "call_a", "name": "get_weather", "arguments": "{\"location\":\"Vail\"}"},
+			{"type": "function_call", "call_id": "call_b", "name": "get_weather", "arguments": "{\"location\":\"Aspen\"}"},
+			{"type": "function_call_output", "call_id": "call_a", "output": "Sunny"},
+			{"type": "function_call_output", "call_id": "call_b", "output": "Snow"}
+		],
+		"tools": [
+			{"type": "function", "name": "get_weather", "parameters": {"type": "object", "properties": {"location": {"type": "string"}}}},
+			{"type": "web_search_preview"}
+		],
+		"tool_choice": {"type": "function", "name": "get_weather"}
+	}`
+	chat := `{
+		"model": "gpt-4o",
+		"messages": [
+			{"role": "system", "content": "Be brief."},
+			{"role": "user", "content": "Weather in Vail and Aspen?"},
+			{"role": "assistant", "content": null, "tool_calls": [
+				{"id": "call_a", "type": "function", "function": {"name": "get_weather", "arguments": "{\"location\":\"Vail\"}"}},
+				{"id": "call_b", "type": "function", "function": {"name": "get_weather", "arguments": "{\"location\":\"Aspen\"}"}}
+			]},
+			{"role": "tool", "tool_call_id": "call_a", "content": "Sunny"},
+			{"role": "tool", "tool_call_id": "call_b", "content": "Snow"}
+		],
+		"tools": [
+			{"type": "function", "function": {"name": "get_weather", "parameters": {"type": "object", "properties": {"location": {"type": "string"}}}}}
+		],
+		"tool_choice": {"type": "function", "function": {"name": "get_weather"}}
+	}`
+
+	want, err := c.CountRequestJSON([]byte(chat))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The reasoning summary is counted, and the built-in tool once it's
+	// calibrated.
+	want += len("Check both.")
+	BuiltinToolTokens["web_search_preview"] = 100
+	defer delete(BuiltinToolTokens, "web_search_preview")
+	want += 100
+
+	got, err := c.CountResponsesRequest([]byte(responses))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Errorf("got %d, want %d", got, want)
+	}
+
+	// A string input is a user message.
+	got, err = c.CountResponsesRequest(map[string]any{"input": "Hi"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, _ := c.CountRequestJSON([]byte(`{"messages":[{"role":"user","content":"Hi"}]}`)); got != want {
+		t.Errorf("string input: got %d, want %d", got, want)
+	}
+
+	if _, err := c.CountResponsesRequest([]byte(`{"input": [{"role": "user", "content": 1}]}`)); err == nil {
+		t.Errorf("invalid content: got nil error")
+	}
+}
+
+func TestCountResponsesOutput(t *testing.T) {
+	c := newTestCounter(t, openai.GPT4o)
+
+	resp := `{"output": [
+		{"type": "reasoning", "summary": [{"type": "summary_text", "text": "Look it up."}]},
+		{"type": "function_call", "call_id": "call_a", "name": "get_weather", "arguments": "{}"},
+		{"type": "message", "role": "assistant", "content": [{"type": "output_text", "text": "Sunny."}]}
+	]}`
+	got, err := c.CountResponsesOutput([]byte(resp))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The call is generated as "functions.get_weather" and its arguments,
+	// with 6 tokens of separators.
+	if want := 11 + 6 + 21 + 2 + 6; got != want {
+		t.Errorf("got %d, want %d", got, want)
+	}
+}
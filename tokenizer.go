@@ -0,0 +1,74 @@
+package tokens
+
+import (
+	"github.com/pkoukk/tiktoken-go"
+)
+
+// Tokenizer converts text to and from tokens. Special tokens such as
+// <|endoftext|> in the text are encoded as ordinary text.
+type Tokenizer interface {
+	Encode(text string) []int
+	Decode(tokens []int) string
+	Count(text string) int
+}
+
+// specialEncoder is implemented by tokenizers that can encode the given
+// special tokens as themselves.
+type specialEncoder interface {
+	EncodeSpecial(text string, allowed []string) []int
+}
+
+// TiktokenTokenizer is the default Tokenizer, backed by tiktoken-go.
+type TiktokenTokenizer struct {
+	tiktoken *tiktoken.Tiktoken
+}
+
+// NewTiktokenTokenizer creates a tokenizer for a tiktoken encoding, such as
+// "o200k_base".
+func NewTiktokenTokenizer(encoding string) (*TiktokenTokenizer, error) {
+	t, err := tiktoken.GetEncoding(encoding)
+	if err != nil {
+		return nil, err
+	}
+	return &TiktokenTokenizer{tiktoken: t}, nil
+}
+
+// tiktokenForModel creates a tokenizer using the encoding of a model.
+func tiktokenForModel(model string) (*TiktokenTokenizer, error) {
+	if encoding, ok := lookupModel(modelEncodings, model); ok {
+		return NewTiktokenTokenizer(encoding)
+	}
+	t, err := tiktoken.EncodingForModel(model)
+	if err != nil {
+		return nil, err
+	}
+	return &TiktokenTokenizer{tiktoken: t}, nil
+}
+
+func (t *TiktokenTokenizer) Encode(text string) []int {
+	return t.tiktoken.Encode(text, nil, nil)
+}
+
+func (t *TiktokenTokenizer) EncodeSpecial(text string, allowed []string) []int {
+	return t.tiktoken.Encode(text, allowed, nil)
+}
+
+func (t *TiktokenTokenizer) Decode(tokens []int) string {
+	return t.tiktoken.Decode(tokens)
+}
+
+func (t *TiktokenTokenizer) Count(text string) int {
+	return len(t.Encode(text))
+}
+
+// Option configures a Counter.
+type Option func(*Counter)
+
+// WithTokenizer makes a Counter use t instead of the tiktoken encoding for
+// its model. All of the request rendering is unchanged, so this is useful for
+// faster BPE implementations, test doubles and other vocabularies.
+func WithTokenizer(t Tokenizer) Option {
+	return func(c *Counter) {
+		c.tokenizer = t
+	}
+}
@@ -0,0 +1,57 @@
+package tokens
+
+import (
+	"testing"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+// runeTokenizer is a test double that encodes each rune as one token, so
+// counts are predictable and no encoding needs to be downloaded.
+type runeTokenizer struct{}
+
+func (runeTokenizer) Encode(text string) []int {
+	var tokens []int
+	for _, r := range text {
+		tokens = append(tokens, int(r))
+	}
+	return tokens
+}
+
+func (runeTokenizer) Decode(tokens []int) string {
+	runes := make([]rune, len(tokens))
+	for i, t := range tokens {
+		runes[i] = rune(t)
+	}
+	return string(runes)
+}
+
+func (runeTokenizer) Count(text string) int {
+	return len([]rune(text))
+}
+
+func newTestCounter(t *testing.T, model string) *Counter {
+	t.Helper()
+	c, err := NewCounter(model, WithTokenizer(runeTokenizer{}))
+	if err != nil {
+		t.Fatalf("NewCounter: %v", err)
+	}
+	return c
+}
+
+func TestWithTokenizer(t *testing.T) {
+	// No tiktoken encoding exists for this model, so only an injected
+	// tokenizer can count it.
+	c := newTestCounter(t, "my-own-model")
+
+	req := openai.ChatCompletionRequest{
+		Messages: []openai.ChatCompletionMessage{{
+			Role:    openai.ChatMessageRoleUser,
+			Content: "Hello",
+		}},
+	}
+	// Priming, message overhead, "user" and "Hello".
+	if got, want := c.CountRequestTokens(req), 3+3+4+5; got != want {
+		t.Errorf("CountRequestTokens: got %d, want %d", got, want)
+	}
+}
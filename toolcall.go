@@ -0,0 +1,59 @@
+package tokens
+
+import "fmt"
+
+// ToolCallFormat is how the tool calls of assistant messages in a request's
+// history are rendered.
+type ToolCallFormat int
+
+const (
+	// ToolCallJSON renders a call's name and arguments as JSON strings, with
+	// the arguments still escaped: "name":"f", "arguments":"{\"a\":1}".
+	ToolCallJSON ToolCallFormat = iota
+	// ToolCallTypeScript renders a call as its recipient, functions.f,
+	// followed by its arguments in TypeScript args format, without quotes
+	// around the keys: {a:1}.
+	ToolCallTypeScript
+)
+
+// ToolCallFormats are the tool call formats of models that don't use
+// ToolCallJSON. Models not listed, including gpt-4o and later, use
+// ToolCallJSON.
+var ToolCallFormats = map[string]ToolCallFormat{
+	"gpt-4":         ToolCallTypeScript,
+	"gpt-4-turbo":   ToolCallTypeScript,
+	"gpt-3.5-turbo": ToolCallTypeScript,
+}
+
+func toolCallFormatFor(model string) ToolCallFormat {
+	format, _ := lookupModel(ToolCallFormats, model)
+	return format
+}
+
+// WithToolCallFormat makes a Counter render tool calls in f instead of the
+// format its model uses.
+func WithToolCallFormat(f ToolCallFormat) Option {
+	return func(c *Counter) {
+		c.toolCallFormat = f
+	}
+}
+
+// encodeToolCall encodes a tool call of an assistant message. Arguments that
+// aren't valid JSON can't be reformatted, and are encoded as they are.
+func (c *Counter) encodeToolCall(tc toolCall) []int {
+	switch c.toolCallFormat {
+	case ToolCallTypeScript:
+		arguments, err := formatArguments(tc.arguments)
+		if err != nil {
+			arguments = tc.arguments
+		}
+		tokens := c.encode("functions." + tc.name)
+		return append(tokens, c.encode(arguments)...)
+	default:
+		return c.encode(fmt.Sprintf(
+			"\"name\":%q, \"arguments\":%q",
+			tc.name,
+			tc.arguments,
+		))
+	}
+}
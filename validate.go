@@ -0,0 +1,286 @@
+package tokens
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+// CountIssue is a problem with a request that either makes its count
+// untrustworthy or will make the API reject it. Path locates the problem in
+// the request's wire format, such as "messages[2].tool_call_id".
+type CountIssue struct {
+	Path    string `json:"path"`
+	Problem string `json:"problem"`
+}
+
+// CountError is returned by the E variants of the Count methods when a
+// request has issues. The count returned with it is still the best estimate
+// available.
+type CountError struct {
+	Issues []CountIssue
+}
+
+func (e *CountError) Error() string {
+	problems := make([]string, len(e.Issues))
+	for i, issue := range e.Issues {
+		problems[i] = issue.Path + ": " + issue.Problem
+	}
+	return "request has issues: " + strings.Join(problems, "; ")
+}
+
+// countError returns a *CountError for issues, or nil if there are none.
+func countError(issues []CountIssue) error {
+	if len(issues) == 0 {
+		return nil
+	}
+	return &CountError{Issues: issues}
+}
+
+// CountRequestTokensE is CountRequestTokens, but also validates the request,
+// returning a *CountError describing any issues found.
+func (c *Counter) CountRequestTokensE(
+	req openai.ChatCompletionRequest,
+) (int, error) {
+	var issues []CountIssue
+	for i, tool := range req.Tools {
+		if tool.Function == nil {
+			issues = append(issues, CountIssue{
+				Path:    fmt.Sprintf("tools[%d]", i),
+				Problem: "tool has no function",
+			})
+			continue
+		}
+		if _, err := toolDefFromOpenAI(*tool.Function); err != nil {
+			issues = append(issues, CountIssue{
+				Path:    fmt.Sprintf("tools[%d].function.parameters", i),
+				Problem: err.Error(),
+			})
+		}
+	}
+	issues = append(issues, openAIToolChoiceIssues(req.ToolChoice)...)
+
+	r := fromOpenAI(req)
+	issues = append(issues, requestIssues(r)...)
+
+	return len(c.render(r).tokens), countError(issues)
+}
+
+// CountChatRequestE is CountChatRequest, but also validates the request,
+// returning a *CountError describing any issues found. Requests that can't
+// be read at all return a *RequestError, as with CountChatRequest.
+func (c *Counter) CountChatRequestE(req any) (int, error) {
+	r, err := chatRequestFrom(req)
+	if err != nil {
+		return 0, err
+	}
+	return len(c.render(r).tokens), countError(requestIssues(r))
+}
+
+// CountMessageTokensE is CountMessageTokens, but also validates the message,
+// returning a *CountError describing any issues found.
+func (c *Counter) CountMessageTokensE(
+	message openai.ChatCompletionMessage,
+) (int, error) {
+	m := messageFromOpenAI(message)
+	return len(c.encodeMessage(m)), countError(toolCallIssues("", m))
+}
+
+// CountToolTokensE is CountToolTokens, but also validates the tools,
+// returning a *CountError describing any issues found.
+func (c *Counter) CountToolTokensE(tools []openai.Tool) (int, error) {
+	var (
+		defs   []toolDef
+		issues []CountIssue
+	)
+	for i, tool := range tools {
+		if tool.Function == nil {
+			issues = append(issues, CountIssue{
+				Path:    fmt.Sprintf("tools[%d]", i),
+				Problem: "tool has no function",
+			})
+			continue
+		}
+		def, err := toolDefFromOpenAI(*tool.Function)
+		if err != nil {
+			issues = append(issues, CountIssue{
+				Path:    fmt.Sprintf("tools[%d].function.parameters", i),
+				Problem: err.Error(),
+			})
+		}
+		issues = append(issues, schemaIssues(fmt.Sprintf("tools[%d].function.parameters", i), def.parameters)...)
+		defs = append(defs, def)
+	}
+
+	return c.tokenizer.Count(formatFunctionDefinitions(defs)) + 3, countError(issues)
+}
+
+// openAIToolChoiceIssues reports go-openai tool choices that aren't counted.
+// Types other than the ones go-openai documents are counted if they marshal
+// to a tool choice.
+func openAIToolChoiceIssues(choice any) []CountIssue {
+	switch choice.(type) {
+	case nil, string, openai.ToolChoice, *openai.ToolChoice, map[string]interface{}, json.RawMessage:
+		// Strings are checked with the other forms in requestIssues.
+		return nil
+	}
+	b, err := json.Marshal(choice)
+	if err == nil {
+		_, err = toolChoiceFromWire(b)
+	}
+	if err != nil {
+		return []CountIssue{{
+			Path:    "tool_choice",
+			Problem: fmt.Sprintf("unsupported tool_choice type %T is not counted", choice),
+		}}
+	}
+	return nil
+}
+
+// requestIssues validates a request's input audio, tool calls, tool
+// messages, tool schemas and tool choice.
+func requestIssues(r chatRequest) []CountIssue {
+	var issues []CountIssue
+
+	calls := make(map[string]bool)
+	for i, m := range r.messages {
+		path := fmt.Sprintf("messages[%d]", i)
+		issues = append(issues, audioIssues(path+".", m)...)
+		issues = append(issues, toolCallIssues(path+".", m)...)
+		for _, tc := range m.toolCalls {
+			calls[tc.id] = true
+		}
+
+		if m.role != openai.ChatMessageRoleTool {
+			continue
+		}
+		switch {
+		case m.toolCallID == "":
+			issues = append(issues, CountIssue{
+				Path:    path + ".tool_call_id",
+				Problem: "tool message has no tool_call_id",
+			})
+		case !calls[m.toolCallID]:
+			issues = append(issues, CountIssue{
+				Path:    path + ".tool_call_id",
+				Problem: fmt.Sprintf("no earlier assistant message calls tool %q", m.toolCallID),
+			})
+		}
+	}
+
+	tools := make(map[string]bool)
+	for _, tool := range r.tools {
+		tools[tool.name] = true
+		issues = append(issues, schemaIssues(tool.path+".parameters", tool.parameters)...)
+	}
+
+	switch r.toolChoice.mode {
+	case "":
+	case toolChoiceNone, toolChoiceAuto, toolChoiceRequired, toolChoiceFunction:
+		if len(r.tools) == 0 {
+			issues = append(issues, CountIssue{
+				Path:    "tool_choice",
+				Problem: "tool_choice is only allowed with tools",
+			})
+		} else if r.toolChoice.mode == toolChoiceFunction && !tools[r.toolChoice.name] {
+			issues = append(issues, CountIssue{
+				Path:    "tool_choice",
+				Problem: fmt.Sprintf("tool_choice names unknown function %q", r.toolChoice.name),
+			})
+		}
+	default:
+		issues = append(issues, CountIssue{
+			Path:    "tool_choice",
+			Problem: fmt.Sprintf("unknown tool_choice %q is not counted", r.toolChoice.mode),
+		})
+	}
+
+	return issues
+}
+
+// audioIssues reports input audio whose duration can't be read, which is
+// counted as no tokens.
+func audioIssues(prefix string, m chatMessage) []CountIssue {
+	var issues []CountIssue
+	for j, part := range m.parts {
+		if part.kind != partAudio {
+			continue
+		}
+		if _, err := inputAudioTokens(part.audioData, part.audioFormat); err != nil {
+			issues = append(issues, CountIssue{
+				Path:    fmt.Sprintf("%scontent[%d].input_audio", prefix, j),
+				Problem: fmt.Sprintf("audio is not counted: %v", err),
+			})
+		}
+	}
+	return issues
+}
+
+// toolCallIssues reports tool calls whose arguments aren't a JSON object.
+func toolCallIssues(prefix string, m chatMessage) []CountIssue {
+	var issues []CountIssue
+	for j, tc := range m.toolCalls {
+		var arguments map[string]interface{}
+		if err := json.Unmarshal([]byte(tc.arguments), &arguments); err != nil {
+			issues = append(issues, CountIssue{
+				Path:    fmt.Sprintf("%stool_calls[%d].function.arguments", prefix, j),
+				Problem: fmt.Sprintf("arguments are not a JSON object: %v", err),
+			})
+		}
+	}
+	return issues
+}
+
+// schemaTypes are the JSON schema types formatType renders.
+var schemaTypes = map[string]bool{
+	"string":  true,
+	"number":  true,
+	"integer": true,
+	"boolean": true,
+	"array":   true,
+	"object":  true,
+	"null":    true,
+}
+
+// schemaIssues reports properties in a tool's parameters whose types can't
+// be rendered, and so aren't counted.
+func schemaIssues(path string, schema map[string]interface{}) []CountIssue {
+	var issues []CountIssue
+
+	properties, _ := schema["properties"].(map[string]interface{})
+	for _, key := range sortedKeys(properties) {
+		propPath := path + ".properties." + key
+		prop, ok := properties[key].(map[string]interface{})
+		if !ok {
+			issues = append(issues, CountIssue{Path: propPath, Problem: "property is not a JSON object"})
+			continue
+		}
+		issues = append(issues, schemaTypeIssues(propPath, prop)...)
+	}
+
+	return issues
+}
+
+func schemaTypeIssues(path string, prop map[string]interface{}) []CountIssue {
+	typ, ok := prop["type"].(string)
+	switch {
+	case prop["type"] == nil:
+		return []CountIssue{{Path: path, Problem: "property has no type"}}
+	case !ok:
+		return []CountIssue{{Path: path + ".type", Problem: "only single types are supported"}}
+	case !schemaTypes[typ]:
+		return []CountIssue{{Path: path + ".type", Problem: fmt.Sprintf("unknown type %q", typ)}}
+	}
+
+	switch typ {
+	case "object":
+		return schemaIssues(path, prop)
+	case "array":
+		if items, ok := prop["items"].(map[string]interface{}); ok {
+			return schemaTypeIssues(path+".items", items)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,168 @@
+package tokens
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/sashabaranov/go-openai"
+	"github.com/sashabaranov/go-openai/jsonschema"
+)
+
+func TestCountRequestTokensE(t *testing.T) {
+	c := newTestCounter(t, openai.GPT4o)
+
+	req := openai.ChatCompletionRequest{
+		Messages: []openai.ChatCompletionMessage{{
+			Role:    openai.ChatMessageRoleUser,
+			Content: "Weather in Vail?",
+		}, {
+			Role: openai.ChatMessageRoleAssistant,
+			ToolCalls: []openai.ToolCall{{
+				ID:       "call_1",
+				Type:     openai.ToolTypeFunction,
+				Function: openai.FunctionCall{Name: "get_current_weather", Arguments: `{"location":`},
+			}},
+		}, {
+			Role:       openai.ChatMessageRoleTool,
+			Content:    "Sunny",
+			ToolCallID: "call_2",
+		}},
+		Tools: []openai.Tool{{
+			Type: openai.ToolTypeFunction,
+			Function: &openai.FunctionDefinition{
+				Name: "get_current_weather",
+				Parameters: jsonschema.Definition{
+					Type: jsonschema.Object,
+					Properties: map[string]jsonschema.Definition{
+						"location": {Type: jsonschema.String},
+						"when":     {Type: "date"},
+						"days": {
+							Type:  jsonschema.Array,
+							Items: &jsonschema.Definition{},
+						},
+					},
+				},
+			},
+		}},
+		ToolChoice: "any",
+	}
+
+	count, err := c.CountRequestTokensE(req)
+	if count != c.CountRequestTokens(req) {
+		t.Errorf("count: got %d, want %d", count, c.CountRequestTokens(req))
+	}
+
+	var countErr *CountError
+	if !errors.As(err, &countErr) {
+		t.Fatalf("got %v, want a *CountError", err)
+	}
+	var paths []string
+	for _, issue := range countErr.Issues {
+		paths = append(paths, issue.Path)
+	}
+	want := []string{
+		"messages[1].tool_calls[0].function.arguments",
+		"messages[2].tool_call_id",
+		"tools[0].function.parameters.properties.days.items",
+		"tools[0].function.parameters.properties.when.type",
+		"tool_choice",
+	}
+	if !reflect.DeepEqual(paths, want) {
+		t.Errorf("issues: got %v, want %v", paths, want)
+	}
+
+	req.Messages[1].ToolCalls[0].Function.Arguments = `{"location":"Vail, CO"}`
+	req.Messages[2].ToolCallID = "call_1"
+	req.Tools[0].Function.Parameters = jsonschema.Definition{Type: jsonschema.Object}
+	req.ToolChoice = nil
+	if _, err := c.CountRequestTokensE(req); err != nil {
+		t.Errorf("valid request: got %v", err)
+	}
+
+	// Other types are counted if they marshal to a tool choice.
+	req.ToolChoice = openai.FunctionCall{Name: "get_current_weather"}
+	if _, err := c.CountRequestTokensE(req); err != nil {
+		t.Errorf("function call tool choice: got %v", err)
+	}
+	req.ToolChoice = 1
+	if _, err := c.CountRequestTokensE(req); err == nil {
+		t.Error("numeric tool choice: got nil error")
+	}
+}
+
+func TestCountToolTokensE(t *testing.T) {
+	c := newTestCounter(t, openai.GPT4o)
+
+	tools := []openai.Tool{
+		{Type: openai.ToolTypeFunction},
+		{Type: openai.ToolTypeFunction, Function: &openai.FunctionDefinition{Name: "f", Parameters: "not a schema"}},
+	}
+	_, err := c.CountToolTokensE(tools)
+	var countErr *CountError
+	if !errors.As(err, &countErr) || len(countErr.Issues) != 2 {
+		t.Errorf("got %v, want 2 issues", err)
+	}
+}
+
+func TestRequestIssuePaths(t *testing.T) {
+	c := newTestCounter(t, openai.GPT4o)
+
+	badSchema := jsonschema.Definition{
+		Type:       jsonschema.Object,
+		Properties: map[string]jsonschema.Definition{"when": {Type: "date"}},
+	}
+	req := openai.ChatCompletionRequest{
+		Messages: []openai.ChatCompletionMessage{{Role: openai.ChatMessageRoleUser, Content: "Hi"}},
+		Tools: []openai.Tool{
+			{Type: openai.ToolTypeFunction},
+			{Type: openai.ToolTypeFunction, Function: &openai.FunctionDefinition{Name: "f", Parameters: badSchema}},
+		},
+		Functions: []openai.FunctionDefinition{{Name: "g", Parameters: badSchema}},
+	}
+	want := []string{
+		"tools[0]",
+		"tools[1].function.parameters.properties.when.type",
+		"functions[0].parameters.properties.when.type",
+	}
+
+	_, err := c.CountRequestTokensE(req)
+	var countErr *CountError
+	if !errors.As(err, &countErr) {
+		t.Fatalf("got %v, want a *CountError", err)
+	}
+	var paths []string
+	for _, issue := range countErr.Issues {
+		paths = append(paths, issue.Path)
+	}
+	if !reflect.DeepEqual(paths, want) {
+		t.Errorf("issues: got %v, want %v", paths, want)
+	}
+
+	// The wire format skips a tool without a function the same way.
+	raw, _ := json.Marshal(req)
+	_, err = c.CountChatRequestE(json.RawMessage(raw))
+	if !errors.As(err, &countErr) {
+		t.Fatalf("JSON: got %v, want a *CountError", err)
+	}
+	paths = nil
+	for _, issue := range countErr.Issues {
+		paths = append(paths, issue.Path)
+	}
+	if !reflect.DeepEqual(paths, want[1:]) {
+		t.Errorf("JSON issues: got %v, want %v", paths, want[1:])
+	}
+}
+
+func TestCountChatRequestNil(t *testing.T) {
+	c := newTestCounter(t, openai.GPT4o)
+
+	for _, req := range []any{(*openai.ChatCompletionRequest)(nil), (*ChatRequest)(nil)} {
+		_, err := c.CountChatRequest(req)
+		var reqErr *RequestError
+		if !errors.As(err, &reqErr) {
+			t.Errorf("%T: got %v, want a *RequestError", req, err)
+		}
+	}
+}